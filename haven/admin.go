@@ -0,0 +1,83 @@
+package haven
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ReadyPongMaxAge is max age of last pong while ready
+const ReadyPongMaxAge = time.Minute * 3
+
+// adminServer serves operational endpoints over http
+type adminServer struct {
+	server *http.Server
+}
+
+// startAdminServer listen addr and serve handler in background
+func startAdminServer(addr string, handler http.Handler) (*adminServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("Listen admin server on %s", ln.Addr())
+	s := &adminServer{server: &http.Server{Handler: handler}}
+	go func() {
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("admin server stopped: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *adminServer) close() {
+	if err := s.server.Close(); err != nil {
+		logger.Warnf("%v", err)
+	}
+}
+
+// adminHandler route admin server endpoints
+func (b *RelayBot) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", b.metrics.handler())
+	mux.HandleFunc("/healthz", b.serveHealthz)
+	mux.HandleFunc("/readyz", b.serveReadyz)
+	return mux
+}
+
+// serveHealthz respond ok unless the bot is stopped
+func (b *RelayBot) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	status := b.ConnectionStatus()
+	if status.State == StateStopped {
+		http.Error(w, fmt.Sprintf("%v", status.State), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
+
+// serveReadyz respond ok while connected and the connection is confirmed alive recently
+func (b *RelayBot) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := b.ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
+
+// ready return why the bot isn't ready. nil if ready.
+func (b *RelayBot) ready() error {
+	status := b.ConnectionStatus()
+	if status.State != StateConnected {
+		return fmt.Errorf("%v since %v", status.State, status.Since.Format(time.RFC3339))
+	}
+	alive := b.transport.lastAlive()
+	if alive.IsZero() {
+		return errors.New("no connection")
+	}
+	if age := time.Since(alive); age > ReadyPongMaxAge {
+		return fmt.Errorf("no pong for %v", age)
+	}
+	return nil
+}
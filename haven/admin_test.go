@@ -0,0 +1,47 @@
+package haven
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminHealth(t *testing.T) {
+	transport := &fakeTransport{}
+	b := &RelayBot{
+		transport: transport,
+		conn:      newConnectionTracker(),
+		metrics:   newMetrics(newMessageLog(newMemoryMessageStore(DefaultMessageLogSize))),
+	}
+	handler := b.adminHandler()
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	if get("/healthz") != http.StatusOK || get("/readyz") != http.StatusServiceUnavailable {
+		t.Error("Expected healthy but not ready while connecting")
+	}
+
+	b.conn.set(StateConnected, nil)
+	transport.alive = time.Now()
+	if get("/readyz") != http.StatusOK {
+		t.Error("Expected ready while connected")
+	}
+
+	transport.alive = time.Now().Add(-ReadyPongMaxAge * 2)
+	if get("/readyz") != http.StatusServiceUnavailable {
+		t.Error("Expected not ready without recent pong")
+	}
+
+	b.conn.set(StateStopped, errors.New("give up"))
+	if get("/healthz") != http.StatusServiceUnavailable {
+		t.Error("Expected unhealthy after stopped")
+	}
+	if get("/metrics") != http.StatusOK {
+		t.Error("Expected metrics are served")
+	}
+}
@@ -0,0 +1,383 @@
+package haven
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+)
+
+// DefaultCommandPrefix is first word of bot commands
+const DefaultCommandPrefix = "haven"
+
+// Permission is level required to run a command
+type Permission int
+
+const (
+	// PermissionMember allows members of relay channels and control channel except guests
+	PermissionMember Permission = iota
+	// PermissionAdmin allows admins by config, or members of control channel if admins aren't configured.
+	// It's accepted only in control channel if it's configured.
+	PermissionAdmin
+)
+
+// commandRequest is a parsed command message
+type commandRequest struct {
+	msg  *message
+	name string
+	args []string
+}
+
+// command is a bot command run by "<prefix> name args..." or "@bot name args..."
+type command struct {
+	name string
+	// args is usage of arguments, ex. "<channel> [group]"
+	args       string
+	help       string
+	permission Permission
+	minArgs    int
+	maxArgs    int
+	// run return reply text
+	run func(b *RelayBot, req *commandRequest) (string, error)
+}
+
+// usage return command usage with trigger
+func (c *command) usage(trigger string) string {
+	if c.args == "" {
+		return trigger + " " + c.name
+	}
+	return trigger + " " + c.name + " " + c.args
+}
+
+// commandRegistry keeps commands by name
+type commandRegistry struct {
+	commands map[string]*command
+}
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{commands: map[string]*command{}}
+}
+
+// register a command. Same name command is replaced.
+func (r *commandRegistry) register(c *command) {
+	r.commands[c.name] = c
+}
+
+func (r *commandRegistry) lookup(name string) (*command, bool) {
+	c, ok := r.commands[name]
+	return c, ok
+}
+
+// sorted return commands in name order
+func (r *commandRegistry) sorted() []*command {
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cmds := make([]*command, len(names))
+	for i, name := range names {
+		cmds[i] = r.commands[name]
+	}
+	return cmds
+}
+
+// commands is registry of bot commands
+var commands = newCommandRegistry()
+
+func init() {
+	commands.register(&command{
+		name: "help",
+		help: "Show commands",
+		run:  (*RelayBot).commandHelp,
+	})
+	commands.register(&command{
+		name: "members",
+		help: "Show members of relay groups of this channel",
+		run: func(b *RelayBot, req *commandRequest) (string, error) {
+			return b.membersInfo(req.msg.Channel), nil
+		},
+	})
+	commands.register(&command{
+		name: "status",
+		help: "Show connection and delivery status",
+		run: func(b *RelayBot, req *commandRequest) (string, error) {
+			return b.botStatus(req.msg.Channel), nil
+		},
+	})
+	commands.register(&command{
+		name:       "add",
+		args:       "<channel>[:direction] [group]",
+		help:       "Relay the channel in the group, default group if omitted",
+		permission: PermissionAdmin,
+		minArgs:    1,
+		maxArgs:    2,
+		run:        (*RelayBot).addRelayChannel,
+	})
+	commands.register(&command{
+		name:       "remove",
+		args:       "<channel> [group]",
+		help:       "Stop relaying the channel in the group, all groups if omitted",
+		permission: PermissionAdmin,
+		minArgs:    1,
+		maxArgs:    2,
+		run:        (*RelayBot).removeRelayChannel,
+	})
+	commands.register(&command{
+		name:       "list",
+		help:       "Show relay groups and channels",
+		permission: PermissionAdmin,
+		run: func(b *RelayBot, req *commandRequest) (string, error) {
+			return b.relayChannelList(), nil
+		},
+	})
+	commands.register(&command{
+		name:       "pause",
+		help:       "Stop relaying of all groups",
+		permission: PermissionAdmin,
+		run: func(b *RelayBot, req *commandRequest) (string, error) {
+			return "Relaying is paused", b.state.setPaused(true)
+		},
+	})
+	commands.register(&command{
+		name:       "resume",
+		help:       "Restart relaying of all groups",
+		permission: PermissionAdmin,
+		run: func(b *RelayBot, req *commandRequest) (string, error) {
+			return "Relaying is resumed", b.state.setPaused(false)
+		},
+	})
+}
+
+// isQuote tests the rune opens or closes a quoted argument.
+// Slack may replace double quotes with smart quotes.
+func isQuote(r rune) bool {
+	return r == '"' || r == '“' || r == '”'
+}
+
+// tokenize split text by spaces. Double quoted text is a token even if it contains spaces.
+func tokenize(text string) []string {
+	tokens := []string{}
+	buf := bytes.Buffer{}
+	quoted := false
+	inToken := false
+	for _, r := range text {
+		switch {
+		case isQuote(r):
+			quoted = !quoted
+			inToken = true
+		case unicode.IsSpace(r) && !quoted:
+			if inToken {
+				tokens = append(tokens, buf.String())
+				buf.Reset()
+				inToken = false
+			}
+		default:
+			buf.WriteRune(r)
+			inToken = true
+		}
+	}
+	if inToken {
+		tokens = append(tokens, buf.String())
+	}
+	return tokens
+}
+
+// isMention tests the token mentions the user, "<@ID>" or "<@ID|name>"
+func isMention(token, userID string) bool {
+	if userID == "" || !strings.HasPrefix(token, "<@") || !strings.HasSuffix(token, ">") {
+		return false
+	}
+	id := token[2 : len(token)-1]
+	if i := strings.Index(id, "|"); i >= 0 {
+		id = id[:i]
+	}
+	return id == userID
+}
+
+// parseCommand parse a message triggered by prefix word or mention to the bot.
+// mentioned is true if it's triggered by mention. ok is false if the message isn't triggered.
+func parseCommand(text, prefix, botID string) (req *commandRequest, mentioned bool, ok bool) {
+	tokens := tokenize(text)
+	if len(tokens) == 0 {
+		return nil, false, false
+	}
+	switch {
+	case isMention(tokens[0], botID):
+		mentioned = true
+	case prefix != "" && strings.EqualFold(tokens[0], prefix):
+	default:
+		return nil, false, false
+	}
+	req = &commandRequest{name: "help"}
+	if len(tokens) > 1 {
+		req.name = strings.ToLower(tokens[1])
+		req.args = tokens[2:]
+	}
+	return req, mentioned, true
+}
+
+// commandPrefix return prefix word of commands. Empty if only mention triggers commands.
+func (b *RelayBot) commandPrefix() string {
+	if b.config.CommandMentionOnly {
+		return ""
+	}
+	if b.config.CommandPrefix == "" {
+		return DefaultCommandPrefix
+	}
+	return b.config.CommandPrefix
+}
+
+// commandTrigger return how to call commands, shown in help
+func (b *RelayBot) commandTrigger() string {
+	if prefix := b.commandPrefix(); prefix != "" {
+		return prefix
+	}
+	return "@" + b.hubUser.Name
+}
+
+// inCommandChannel tests commands are answered in the channel, relay channels and control channel
+func (b *RelayBot) inCommandChannel(cID string) bool {
+	return b.inControlChannel(cID) || b.relayGroups.hasChannel(cID)
+}
+
+func (b *RelayBot) inControlChannel(cID string) bool {
+	return b.config.ControlChannel != "" && cID == b.config.ControlChannel
+}
+
+// isAdmin tests the user is admin by AdminUsers or workspace role
+func (b *RelayBot) isAdmin(u *user) bool {
+	for _, id := range b.config.AdminUsers {
+		if id == u.ID {
+			return true
+		}
+	}
+	return b.config.WorkspaceAdmins && (u.IsAdmin || u.IsOwner)
+}
+
+// authorize tests the sender of the message can run commands of the permission.
+// Guests are denied. Admin commands are accepted only in control channel if it's configured.
+// Without admin roles in config, members of control channel are admins.
+func (b *RelayBot) authorize(p Permission, msg *message) error {
+	u, err := b.users.get(msg.User)
+	if err != nil {
+		logger.Warnf("cant fetch user %s: %v", msg.User, err)
+		return errors.New("user is unknown")
+	}
+	if u.IsRestricted || u.IsUltraRestricted {
+		return errors.New("guests can't run commands")
+	}
+	if p == PermissionMember {
+		return nil
+	}
+	roles := len(b.config.AdminUsers) > 0 || b.config.WorkspaceAdmins
+	if !b.inControlChannel(msg.Channel) && (b.config.ControlChannel != "" || !roles) {
+		return errors.New("accepted only in control channel")
+	}
+	if roles && !b.isAdmin(&u) {
+		return errors.New("admins only")
+	}
+	return nil
+}
+
+// isCommand tests the text is handled as a bot command by handleCommand
+func (b *RelayBot) isCommand(text string) bool {
+	req, mentioned, ok := parseCommand(text, b.commandPrefix(), b.hubUser.ID)
+	if !ok {
+		return false
+	}
+	cmd, ok := commands.lookup(req.name)
+	return mentioned || ok && len(req.args) >= cmd.minArgs && len(req.args) <= cmd.maxArgs
+}
+
+// handleCommand run a bot command in the message.
+// It returns false if the message isn't a command, then it's relayed as usual.
+func (b *RelayBot) handleCommand(msg *message) bool {
+	req, mentioned, ok := parseCommand(msg.Text, b.commandPrefix(), b.hubUser.ID)
+	if !ok {
+		return false
+	}
+	req.msg = msg
+	cmd, ok := commands.lookup(req.name)
+	fits := ok && len(req.args) >= cmd.minArgs && len(req.args) <= cmd.maxArgs
+	if !fits && !mentioned {
+		// "haven" is just a word unless it's followed by a command
+		return false
+	}
+	if !b.inCommandChannel(msg.Channel) {
+		// not answered outside relay channels
+		return true
+	}
+	if !ok {
+		b.postCommandResult(msg, fmt.Sprintf("Unknown command %q. See `%s help`", req.name, b.commandTrigger()))
+		return true
+	}
+	if err := b.authorize(cmd.permission, msg); err != nil {
+		logger.Warnf("command %q by %s in %s is denied: %v", msg.Text, msg.User, msg.Channel, err)
+		b.postEphemeral(msg, fmt.Sprintf("`%s` is not permitted, %v", cmd.name, err))
+		return true
+	}
+
+	var reply string
+	var err error
+	if fits {
+		logger.Infof("command %q by %s in %s", msg.Text, msg.User, msg.Channel)
+		reply, err = cmd.run(b, req)
+	} else {
+		err = fmt.Errorf("usage: %s", cmd.usage(b.commandTrigger()))
+	}
+	if err != nil {
+		reply = fmt.Sprintf("Error: %v", err)
+	}
+	b.postCommandResult(msg, reply)
+	return true
+}
+
+// postCommandResult answer command result only to the sender, or to the channel if PublicReplies is set
+func (b *RelayBot) postCommandResult(msg *message, text string) {
+	if !b.config.PublicReplies {
+		b.postEphemeral(msg, text)
+		return
+	}
+	pm := postMessageRequest{
+		Channel:  msg.Channel,
+		Text:     text,
+		UserName: "Slack haven",
+		ThreadTs: msg.ThreadTs,
+	}
+	if _, err := b.api.postMessage(pm); err != nil {
+		logger.Warnf("%v", err)
+	}
+}
+
+// postEphemeral answer a command only to the sender
+func (b *RelayBot) postEphemeral(msg *message, text string) {
+	pe := postEphemeralRequest{
+		Channel:  msg.Channel,
+		User:     msg.User,
+		Text:     text,
+		UserName: "Slack haven",
+		ThreadTs: msg.ThreadTs,
+	}
+	if err := b.api.postEphemeral(pe); err != nil {
+		logger.Warnf("%v", err)
+	}
+}
+
+// commandHelp show commands which the requester can run
+func (b *RelayBot) commandHelp(req *commandRequest) (string, error) {
+	buf := bytes.Buffer{}
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	buf.WriteString("```\n")
+	for _, cmd := range commands.sorted() {
+		if b.authorize(cmd.permission, req.msg) == nil {
+			fmt.Fprintf(tw, "%s\t%s\n", cmd.usage(b.commandTrigger()), cmd.help)
+		}
+	}
+	tw.Flush()
+	buf.WriteString("```\n")
+	return buf.String(), nil
+}
@@ -0,0 +1,272 @@
+package haven
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	cases := map[string][]string{
+		"haven add C1":               {"haven", "add", "C1"},
+		"  haven\tadd \n C1  ":       {"haven", "add", "C1"},
+		`haven add "two words" C1`:   {"haven", "add", "two words", "C1"},
+		"haven add “smart quote”":    {"haven", "add", "smart quote"},
+		`haven add ""`:               {"haven", "add", ""},
+		"":                           {},
+		"<@U1> status":               {"<@U1>", "status"},
+		`haven add "unterminated C1`: {"haven", "add", "unterminated C1"},
+	}
+	for input, expected := range cases {
+		if actual := tokenize(input); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("tokenize(%q) Expected %q. Actual: %q", input, expected, actual)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	cases := []struct {
+		text      string
+		prefix    string
+		name      string
+		args      []string
+		mentioned bool
+		ok        bool
+	}{
+		{"haven status", "haven", "status", []string{}, false, true},
+		{"Haven ADD C1 news", "haven", "add", []string{"C1", "news"}, false, true},
+		{"haven", "haven", "help", nil, false, true},
+		{"<@U1> members", "haven", "members", []string{}, true, true},
+		{"<@U1|haven> status", "", "status", []string{}, true, true},
+		{"haven, what's the status of the PR", "haven", "", nil, false, false},
+		{"safe haven status", "haven", "", nil, false, false},
+		{"haven status", "", "", nil, false, false},
+		{"<@U2> status", "haven", "", nil, false, false},
+		{"!status", "!", "", nil, false, false},
+		{"! status", "!", "status", []string{}, false, true},
+	}
+	for _, c := range cases {
+		req, mentioned, ok := parseCommand(c.text, c.prefix, "U1")
+		if ok != c.ok || mentioned != c.mentioned {
+			t.Errorf("parseCommand(%q) Expected ok %v mentioned %v. Actual: %v %v", c.text, c.ok, c.mentioned, ok, mentioned)
+			continue
+		}
+		if ok && (req.name != c.name || !reflect.DeepEqual(req.args, c.args)) {
+			t.Errorf("parseCommand(%q) Expected %v %q. Actual: %v %q", c.text, c.name, c.args, req.name, req.args)
+		}
+	}
+}
+
+func TestCommandRegistry(t *testing.T) {
+	r := newCommandRegistry()
+	r.register(&command{name: "b"})
+	r.register(&command{name: "a", help: "first"})
+	r.register(&command{name: "a", help: "replaced"})
+	if c, ok := r.lookup("a"); !ok || c.help != "replaced" {
+		t.Errorf("Expected replaced command. Actual: %+v", c)
+	}
+	if _, ok := r.lookup("c"); ok {
+		t.Error("Expected unknown command")
+	}
+	cmds := r.sorted()
+	if len(cmds) != 2 || cmds[0].name != "a" || cmds[1].name != "b" {
+		t.Errorf("Expected sorted commands. Actual: %v", cmds)
+	}
+	if u := (&command{name: "add", args: "<channel>"}).usage("haven"); u != "haven add <channel>" {
+		t.Errorf("Unexpected usage %q", u)
+	}
+}
+
+// newTestCommandAPI start api server answering users.info with users,
+// posted and ephemeral messages are recorded in replies.
+func newTestCommandAPI(t *testing.T, users map[string]user, replies *[]string) (*apiClient, func()) {
+	api, _, closer := newTestAPIClient(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/users.info":
+			u, ok := users[r.URL.Query().Get("user")]
+			if !ok {
+				w.Write([]byte(`{"ok": false, "error": "user_not_found"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(userInfoResponse{Ok: true, User: u})
+		case "/chat.postEphemeral":
+			pe := postEphemeralRequest{}
+			json.NewDecoder(r.Body).Decode(&pe)
+			*replies = append(*replies, "ephemeral to "+pe.User+": "+pe.Text)
+			w.Write([]byte(`{"ok": true}`))
+		case "/chat.postMessage":
+			pm := postMessageRequest{}
+			json.NewDecoder(r.Body).Decode(&pm)
+			*replies = append(*replies, pm.Text)
+			w.Write([]byte(`{"ok": true, "ts": "1.000001"}`))
+		default:
+			t.Errorf("Unexpected api call %v", r.URL.Path)
+		}
+	})
+	return api, closer
+}
+
+func TestHandleCommand(t *testing.T) {
+	replies := []string{}
+	api, closer := newTestCommandAPI(t, map[string]user{"A": {ID: "A"}}, &replies)
+	defer closer()
+
+	cfg := &Config{
+		ControlChannel: "C0",
+		RelayGroups:    map[string]map[string]RelayDirection{"a": {"C1": Bidirectional, "C2": Bidirectional}},
+	}
+	b := &RelayBot{
+		config:      cfg,
+		relayGroups: newRelayGroups(cfg, []channel{{ID: "C1"}, {ID: "C2"}}),
+		api:         api,
+		users:       newUserCache(api.fetchUserInfo),
+		hubUser:     self{ID: "U1", Name: "havenbot"},
+	}
+	run := func(channelID, text string) (bool, []string) {
+		replies = replies[:0]
+		handled := b.handleCommand(&message{Channel: channelID, User: "A", Text: text})
+		return handled, replies
+	}
+
+	if handled, _ := run("C1", "haven is a nice word"); handled {
+		t.Error("Expected unknown command by prefix is relayed")
+	}
+	if handled, _ := run("C1", "haven status of the PR is good"); handled {
+		t.Error("Expected command with wrong arguments by prefix is relayed")
+	}
+	if handled, r := run("C1", "<@U1> dance"); !handled || len(r) != 1 || !strings.Contains(r[0], `Unknown command "dance". See `+"`haven help`") {
+		t.Errorf("Expected unknown command reply. Actual: %v", r)
+	}
+	if handled, r := run("C1", "<@U1> add"); !handled || len(r) != 1 || !strings.Contains(r[0], "ephemeral to A: `add` is not permitted, accepted only in control channel") {
+		t.Errorf("Expected admin command is denied. Actual: %v", r)
+	}
+	if handled, r := run("C9", "haven help"); !handled || len(r) != 0 {
+		t.Errorf("Expected command outside relay channels is not answered. Actual: %v", r)
+	}
+
+	_, r := run("C1", "haven help")
+	if len(r) != 1 || !strings.Contains(r[0], "haven members") || strings.Contains(r[0], "haven pause") {
+		t.Errorf("Expected help shows only member commands. Actual: %v", r)
+	}
+	_, r = run("C0", "haven help")
+	if len(r) != 1 || !strings.Contains(r[0], "haven add <channel>[:direction] [group]") {
+		t.Errorf("Expected help shows admin commands in control channel. Actual: %v", r)
+	}
+	_, r = run("C0", "<@U1> add")
+	if len(r) != 1 || !strings.Contains(r[0], "Error: usage: haven add <channel>[:direction] [group]") {
+		t.Errorf("Expected usage. Actual: %v", r)
+	}
+
+	// results are answered only to the sender unless public replies are configured
+	if _, r = run("C1", "haven help"); len(r) != 1 || !strings.HasPrefix(r[0], "ephemeral to A: ") {
+		t.Errorf("Expected ephemeral result. Actual: %v", r)
+	}
+	cfg.PublicReplies = true
+	if _, r = run("C1", "haven help"); len(r) != 1 || !strings.Contains(r[0], "haven members") || strings.HasPrefix(r[0], "ephemeral") {
+		t.Errorf("Expected public result. Actual: %v", r)
+	}
+	if _, r = run("C1", "<@U1> add"); len(r) != 1 || !strings.HasPrefix(r[0], "ephemeral to A: ") {
+		t.Errorf("Expected denial is still ephemeral. Actual: %v", r)
+	}
+	cfg.PublicReplies = false
+
+	cfg.CommandMentionOnly = true
+	if handled, _ := run("C1", "haven help"); handled {
+		t.Error("Expected prefix is disabled")
+	}
+	_, r = run("C1", "<@U1>")
+	if len(r) != 1 || !strings.Contains(r[0], "@havenbot status") {
+		t.Errorf("Expected help with mention. Actual: %v", r)
+	}
+}
+
+func TestCommandPermission(t *testing.T) {
+	replies := []string{}
+	users := map[string]user{
+		"UMEMBER": {ID: "UMEMBER"},
+		"UADMIN":  {ID: "UADMIN"},
+		"UOWNER":  {ID: "UOWNER", IsOwner: true},
+		"UWSADM":  {ID: "UWSADM", IsAdmin: true},
+		"UGUEST":  {ID: "UGUEST", IsRestricted: true},
+		"USINGLE": {ID: "USINGLE", IsUltraRestricted: true},
+	}
+	api, closer := newTestCommandAPI(t, users, &replies)
+	defer closer()
+
+	cfg := &Config{
+		ControlChannel: "C0",
+		RelayGroups:    map[string]map[string]RelayDirection{"a": {"C1": Bidirectional, "C2": Bidirectional}},
+	}
+	state, cleanup := openTestRelayState(t)
+	defer cleanup()
+	b := &RelayBot{
+		config:      cfg,
+		relayGroups: newRelayGroups(cfg, []channel{{ID: "C1"}, {ID: "C2"}}),
+		api:         api,
+		users:       newUserCache(api.fetchUserInfo),
+		state:       state,
+	}
+	allowed := func(userID, channelID string, p Permission) bool {
+		return b.authorize(p, &message{Channel: channelID, User: userID}) == nil
+	}
+
+	// without admin roles, members of control channel are admins
+	if !allowed("UMEMBER", "C0", PermissionAdmin) || allowed("UMEMBER", "C1", PermissionAdmin) {
+		t.Error("Expected control channel members are admins")
+	}
+	for _, guest := range []string{"UGUEST", "USINGLE"} {
+		if allowed(guest, "C1", PermissionMember) || allowed(guest, "C0", PermissionAdmin) {
+			t.Errorf("Expected guest %s is denied", guest)
+		}
+	}
+	if allowed("UNKNOWN", "C1", PermissionMember) {
+		t.Error("Expected unknown user is denied")
+	}
+
+	cfg.AdminUsers = []string{"UADMIN"}
+	if !allowed("UADMIN", "C0", PermissionAdmin) || allowed("UMEMBER", "C0", PermissionAdmin) || allowed("UOWNER", "C0", PermissionAdmin) {
+		t.Error("Expected only admin users are admins")
+	}
+	if !allowed("UMEMBER", "C1", PermissionMember) {
+		t.Error("Expected members can run member commands")
+	}
+	// admin commands are accepted only in control channel even by admins
+	if allowed("UADMIN", "C1", PermissionAdmin) {
+		t.Error("Expected admin command is denied outside control channel")
+	}
+
+	cfg.WorkspaceAdmins = true
+	if !allowed("UOWNER", "C0", PermissionAdmin) || !allowed("UWSADM", "C0", PermissionAdmin) || allowed("UMEMBER", "C0", PermissionAdmin) {
+		t.Error("Expected workspace admins and owners are admins")
+	}
+
+	// denied attempt is answered only to the sender
+	replies = replies[:0]
+	b.handleCommand(&message{Channel: "C0", User: "UMEMBER", Text: "haven pause"})
+	if b.state.paused() || len(replies) != 1 || replies[0] != "ephemeral to UMEMBER: `pause` is not permitted, admins only" {
+		t.Errorf("Expected ephemeral denial. Actual: %v", replies)
+	}
+	replies = replies[:0]
+	b.handleCommand(&message{Channel: "C1", User: "UADMIN", Text: "haven pause"})
+	if b.state.paused() || len(replies) != 1 || replies[0] != "ephemeral to UADMIN: `pause` is not permitted, accepted only in control channel" {
+		t.Errorf("Expected denial outside control channel. Actual: %v", replies)
+	}
+	replies = replies[:0]
+	b.handleCommand(&message{Channel: "C0", User: "UADMIN", Text: "haven pause"})
+	if !b.state.paused() || len(replies) != 1 {
+		t.Errorf("Expected admin can pause. Actual: %v", replies)
+	}
+
+	// without control channel, admins can run admin commands in relay channels
+	cfg.ControlChannel = ""
+	if !allowed("UADMIN", "C1", PermissionAdmin) || allowed("UMEMBER", "C1", PermissionAdmin) {
+		t.Error("Expected admins can run admin commands in relay channels")
+	}
+	replies = replies[:0]
+	b.handleCommand(&message{Channel: "C1", User: "UGUEST", Text: "haven help"})
+	if len(replies) != 1 || replies[0] != "ephemeral to UGUEST: `help` is not permitted, guests can't run commands" {
+		t.Errorf("Expected guest is denied. Actual: %v", replies)
+	}
+}
@@ -1,55 +1,563 @@
 package haven
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/mitchellh/go-homedir"
+	"gopkg.in/yaml.v3"
 )
 
+const (
+	// DefaultGroupName is relay group name used for unnamed relay rooms
+	DefaultGroupName = "default"
+	// DefaultConfigFile is config file name in home directory read when no config file is given
+	DefaultConfigFile = ".slack-haven"
+	// StateFileSuffix is appended to config file path to make default state file path
+	StateFileSuffix = ".state"
+	// EnvPrefix is prefix of environment variables overwriting config file
+	EnvPrefix = "SLACK_HAVEN_"
+)
+
+// channelIDPattern matches public, private and DM channel ids
+var channelIDPattern = regexp.MustCompile(`^[CGD][A-Z0-9]{2,}$`)
+
+// userIDPattern matches user ids, W is enterprise grid user
+var userIDPattern = regexp.MustCompile(`^[UW][A-Z0-9]+$`)
+
+// RelayDirection is relaying direction of a channel in relay group
+type RelayDirection int
+
+const (
+	// Bidirectional channel sends and receives messages
+	Bidirectional RelayDirection = iota
+	// SendOnly channel sends messages but never receives
+	SendOnly
+	// ReceiveOnly channel receives messages but never sends
+	ReceiveOnly
+)
+
+var relayDirectionNames = map[string]RelayDirection{
+	"bidirectional": Bidirectional,
+	"send-only":     SendOnly,
+	"receive-only":  ReceiveOnly,
+}
+
+// canSend tests messages posted on the channel are relayed
+func (d RelayDirection) canSend() bool {
+	return d != ReceiveOnly
+}
+
+// canReceive tests messages are relayed to the channel
+func (d RelayDirection) canReceive() bool {
+	return d != SendOnly
+}
+
+// String return direction name
+func (d RelayDirection) String() string {
+	for name, dir := range relayDirectionNames {
+		if dir == d {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// ParseRelayRoom parse relay room definition "ID[:direction]".
+// direction is one of bidirectional, send-only and receive-only.
+func ParseRelayRoom(spec string) (string, RelayDirection, error) {
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return spec, Bidirectional, nil
+	}
+	dir, ok := relayDirectionNames[spec[i+1:]]
+	if !ok {
+		return "", Bidirectional, fmt.Errorf("Unknown relay direction %q", spec[i+1:])
+	}
+	return spec[:i], dir, nil
+}
+
+// ParseRelayRooms parse relay room definitions into channel id to direction map
+func ParseRelayRooms(specs []string) (map[string]RelayDirection, error) {
+	rooms := make(map[string]RelayDirection, len(specs))
+	for _, spec := range specs {
+		id, dir, err := ParseRelayRoom(spec)
+		if err != nil {
+			return nil, err
+		}
+		rooms[id] = dir
+	}
+	return rooms, nil
+}
+
+// ParseRelayGroups parse relay groups definition.
+// Groups are separated by ";" and optionally named with "name=" prefix.
+// Each channel optionally has ":direction" suffix.
+// ex. "id1,id2" or "a=id1:send-only,id2:receive-only;b=id3,id4"
+func ParseRelayGroups(spec string) (map[string]map[string]RelayDirection, error) {
+	groups := strings.Split(spec, ";")
+	groupConf := make(map[string]map[string]RelayDirection, len(groups))
+	for _, group := range groups {
+		name := DefaultGroupName
+		if i := strings.Index(group, "="); i >= 0 {
+			name = group[:i]
+			group = group[i+1:]
+		}
+		rooms, err := ParseRelayRooms(strings.Split(group, ","))
+		if err != nil {
+			return nil, err
+		}
+		groupConf[name] = rooms
+	}
+	return groupConf, nil
+}
+
 // Config relay channels
 type Config struct {
-	RelayRooms map[string]struct{}
-	Token      string
+	// RelayGroups maps group name to relay channel ids and their direction
+	RelayGroups map[string]map[string]RelayDirection
+	Token       string
+	// TokenFile is file path to read token from, such as docker or kubernetes secret.
+	// It takes precedence over Token given at same place.
+	TokenFile string
+	// MessageLogPath is message log file path. Message log is kept on memory if empty.
+	MessageLogPath string
+	// MessageRetention is how long message log file keeps relayed message ids
+	MessageRetention time.Duration
+	// OutboxPath is file path of outbox which keeps undelivered api calls.
+	// Undelivered calls are lost by restart if empty.
+	OutboxPath string
+	// LastSeenPath is file path to keep latest message ts of each relay channel.
+	// Messages missed while disconnected are caught up from it.
+	LastSeenPath string
+	// ReconnectMinWait is first wait before retrying connection
+	ReconnectMinWait time.Duration
+	// ReconnectMaxWait is max wait between connection attempts
+	ReconnectMaxWait time.Duration
+	// ReconnectMaxAttempts is connection attempts before giving up. 0 is unlimited.
+	ReconnectMaxAttempts int
+	// ShutdownTimeout is how long pending deliveries are waited on shutdown
+	ShutdownTimeout time.Duration
+	// AdminAddr is listen address of admin http server serving health check and metrics. Disabled if empty.
+	AdminAddr string
+	// ControlChannel is channel id where admin commands managing relay channels are accepted. Disabled if empty.
+	ControlChannel string
+	// AdminUsers is user ids allowed to run admin commands
+	AdminUsers []string
+	// WorkspaceAdmins allows workspace admins and owners to run admin commands.
+	// Members of ControlChannel are admins unless AdminUsers or WorkspaceAdmins is given.
+	WorkspaceAdmins bool
+	// CommandPrefix is first word of bot commands. "haven" if empty.
+	CommandPrefix string
+	// CommandMentionOnly accepts only commands mentioning the bot, ex. "@haven status"
+	CommandMentionOnly bool
+	// PublicReplies posts command results to the channel instead of only to the sender
+	PublicReplies bool
+	// StatePath is file path to keep relay channels and pause changed by admin commands.
+	// Admin commands changing them are refused if empty, they would be lost by restart.
+	StatePath string
+	// DeleteOrigin deletes the origin and other copies when a relayed copy is deleted
+	DeleteOrigin bool
+	// Transport is how to receive events. rtm, socket-mode or events-api
+	Transport string
+	// AppToken is app level token used by socket mode
+	AppToken string
+	// SigningSecret verifies events api requests
+	SigningSecret string
+	// EventsAddr is listen address of events api receiver
+	EventsAddr string
 }
 
-type configJSON struct {
-	RelayRooms []string `json:"relay-rooms"`
-	Token      string   `json:"token"`
+// configFile is schema of config file. Keys are same in json, yaml and toml.
+type configFile struct {
+	RelayRooms           []string            `json:"relay-rooms" yaml:"relay-rooms" toml:"relay-rooms"`
+	RelayGroups          map[string][]string `json:"relay-groups" yaml:"relay-groups" toml:"relay-groups"`
+	Token                string              `json:"token" yaml:"token" toml:"token"`
+	TokenFile            string              `json:"token-file" yaml:"token-file" toml:"token-file"`
+	MessageLogPath       string              `json:"message-log" yaml:"message-log" toml:"message-log"`
+	MessageRetention     string              `json:"message-retention" yaml:"message-retention" toml:"message-retention"`
+	OutboxPath           string              `json:"outbox" yaml:"outbox" toml:"outbox"`
+	LastSeenPath         string              `json:"last-seen" yaml:"last-seen" toml:"last-seen"`
+	ReconnectMinWait     string              `json:"reconnect-min-wait" yaml:"reconnect-min-wait" toml:"reconnect-min-wait"`
+	ReconnectMaxWait     string              `json:"reconnect-max-wait" yaml:"reconnect-max-wait" toml:"reconnect-max-wait"`
+	ReconnectMaxAttempts int                 `json:"reconnect-max-attempts" yaml:"reconnect-max-attempts" toml:"reconnect-max-attempts"`
+	ShutdownTimeout      string              `json:"shutdown-timeout" yaml:"shutdown-timeout" toml:"shutdown-timeout"`
+	DeleteOrigin         bool                `json:"delete-origin" yaml:"delete-origin" toml:"delete-origin"`
+	Transport            string              `json:"transport" yaml:"transport" toml:"transport"`
+	AppToken             string              `json:"app-token" yaml:"app-token" toml:"app-token"`
+	SigningSecret        string              `json:"signing-secret" yaml:"signing-secret" toml:"signing-secret"`
+	EventsAddr           string              `json:"events-addr" yaml:"events-addr" toml:"events-addr"`
+	AdminAddr            string              `json:"admin-addr" yaml:"admin-addr" toml:"admin-addr"`
+	ControlChannel       string              `json:"control-channel" yaml:"control-channel" toml:"control-channel"`
+	StatePath            string              `json:"state" yaml:"state" toml:"state"`
+	AdminUsers           []string            `json:"admin-users" yaml:"admin-users" toml:"admin-users"`
+	WorkspaceAdmins      bool                `json:"workspace-admins" yaml:"workspace-admins" toml:"workspace-admins"`
+	CommandPrefix        string              `json:"command-prefix" yaml:"command-prefix" toml:"command-prefix"`
+	CommandMentionOnly   bool                `json:"command-mention-only" yaml:"command-mention-only" toml:"command-mention-only"`
+	PublicReplies        bool                `json:"public-replies" yaml:"public-replies" toml:"public-replies"`
 }
 
-// ConfigLoadFromFile read config file
-func ConfigLoadFromFile(c *Config) error {
+// DefaultConfigPath return path of config file in home directory
+func DefaultConfigPath() (string, error) {
 	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(home, DefaultConfigFile), nil
+}
+
+// DefaultStatePath return state file path next to the config file.
+// Empty config path means the config file in home directory.
+func DefaultStatePath(configPath string) (string, error) {
+	if configPath == "" {
+		var err error
+		if configPath, err = DefaultConfigPath(); err != nil {
+			return "", err
+		}
+	}
+	return configPath + StateFileSuffix, nil
+}
+
+// ConfigLoadFromFile read config file.
+// Format is chosen by extension, .yaml, .yml, .toml or json otherwise.
+// Empty path reads ~/.slack-haven, and it's not an error that the file doesn't exist.
+func ConfigLoadFromFile(c *Config, configPath string) error {
+	if configPath == "" {
+		var err error
+		if configPath, err = DefaultConfigPath(); err != nil {
+			return err
+		}
+		if _, err := os.Stat(configPath); os.IsNotExist(err) {
+			return nil
+		}
+	}
 
+	buf, err := ioutil.ReadFile(configPath)
 	if err != nil {
 		return err
 	}
 
-	// Try read config file
-	// TODO pass from command line argument
-	configPath := path.Join(home, ".slack-haven")
-	if _, err := os.Stat(configPath); err != nil {
+	conf := configFile{}
+	if err := decodeConfig(configPath, buf, &conf); err != nil {
+		return fmt.Errorf("config %s: %v", configPath, err)
+	}
+	if err := conf.apply(c); err != nil {
+		return fmt.Errorf("config %s: %v", configPath, err)
+	}
+	return nil
+}
+
+// decodeConfig decode config file by its extension. Unknown keys are error.
+func decodeConfig(configPath string, buf []byte, conf *configFile) error {
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(buf))
+		dec.KnownFields(true)
+		if err := dec.Decode(conf); err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	case ".toml":
+		meta, err := toml.Decode(string(buf), conf)
+		if err != nil {
+			return err
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return fmt.Errorf("unknown keys %s", strings.Join(keys, ", "))
+		}
+		return nil
+	default:
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.DisallowUnknownFields()
+		return dec.Decode(conf)
+	}
+}
+
+// apply set config file values to c
+func (conf *configFile) apply(c *Config) error {
+	c.Token = conf.Token
+	c.TokenFile = conf.TokenFile
+	c.MessageLogPath = conf.MessageLogPath
+	c.OutboxPath = conf.OutboxPath
+	c.LastSeenPath = conf.LastSeenPath
+	c.ReconnectMaxAttempts = conf.ReconnectMaxAttempts
+	c.DeleteOrigin = conf.DeleteOrigin
+	c.Transport = conf.Transport
+	c.AppToken = conf.AppToken
+	c.SigningSecret = conf.SigningSecret
+	c.EventsAddr = conf.EventsAddr
+	c.AdminAddr = conf.AdminAddr
+	c.ControlChannel = conf.ControlChannel
+	c.StatePath = conf.StatePath
+	c.AdminUsers = conf.AdminUsers
+	c.WorkspaceAdmins = conf.WorkspaceAdmins
+	c.CommandPrefix = conf.CommandPrefix
+	c.CommandMentionOnly = conf.CommandMentionOnly
+	c.PublicReplies = conf.PublicReplies
+
+	err := parseDurations([]durationValue{
+		{"message-retention", conf.MessageRetention, &c.MessageRetention},
+		{"reconnect-min-wait", conf.ReconnectMinWait, &c.ReconnectMinWait},
+		{"reconnect-max-wait", conf.ReconnectMaxWait, &c.ReconnectMaxWait},
+		{"shutdown-timeout", conf.ShutdownTimeout, &c.ShutdownTimeout},
+	})
+	if err != nil {
 		return err
 	}
 
-	buf, err := ioutil.ReadFile(configPath)
+	c.RelayGroups = make(map[string]map[string]RelayDirection, len(conf.RelayGroups)+1)
+
+	// relay-rooms is kept as the default group
+	if len(conf.RelayRooms) > 0 {
+		rooms, err := ParseRelayRooms(conf.RelayRooms)
+		if err != nil {
+			return fmt.Errorf("relay-rooms: %v", err)
+		}
+		c.RelayGroups[DefaultGroupName] = rooms
+	}
+	for name, specs := range conf.RelayGroups {
+		rooms, err := ParseRelayRooms(specs)
+		if err != nil {
+			return fmt.Errorf("relay group %s: %v", name, err)
+		}
+		c.RelayGroups[name] = rooms
+	}
+
+	return nil
+}
+
+// durationValue is a duration text to parse into dst. key names it in errors.
+type durationValue struct {
+	key   string
+	value string
+	dst   *time.Duration
+}
+
+// parseDurations parse non empty values
+func parseDurations(durations []durationValue) error {
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", d.key, err)
+		}
+		*d.dst = v
+	}
+	return nil
+}
+
+// ConfigLoadFromEnv overwrite config with non empty SLACK_HAVEN_* environment variables.
+// Variable name is upper cased config key with "_", ex. SLACK_HAVEN_MESSAGE_LOG.
+// Relay groups are given by SLACK_HAVEN_CHANNEL in same format as channel option.
+func ConfigLoadFromEnv(c *Config) error {
+	env := func(key string) string {
+		return os.Getenv(EnvPrefix + key)
+	}
+
+	if v := env("TOKEN"); v != "" {
+		// token overwrites token file given by config file
+		c.Token = v
+		c.TokenFile = ""
+	}
+	strs := []struct {
+		key string
+		dst *string
+	}{
+		{"TOKEN_FILE", &c.TokenFile},
+		{"MESSAGE_LOG", &c.MessageLogPath},
+		{"OUTBOX", &c.OutboxPath},
+		{"LAST_SEEN", &c.LastSeenPath},
+		{"ADMIN_ADDR", &c.AdminAddr},
+		{"CONTROL_CHANNEL", &c.ControlChannel},
+		{"STATE", &c.StatePath},
+		{"COMMAND_PREFIX", &c.CommandPrefix},
+		{"TRANSPORT", &c.Transport},
+		{"APP_TOKEN", &c.AppToken},
+		{"SIGNING_SECRET", &c.SigningSecret},
+		{"EVENTS_ADDR", &c.EventsAddr},
+	}
+	for _, s := range strs {
+		if v := env(s.key); v != "" {
+			*s.dst = v
+		}
+	}
+
+	err := parseDurations([]durationValue{
+		{EnvPrefix + "MESSAGE_RETENTION", env("MESSAGE_RETENTION"), &c.MessageRetention},
+		{EnvPrefix + "RECONNECT_MIN_WAIT", env("RECONNECT_MIN_WAIT"), &c.ReconnectMinWait},
+		{EnvPrefix + "RECONNECT_MAX_WAIT", env("RECONNECT_MAX_WAIT"), &c.ReconnectMaxWait},
+		{EnvPrefix + "SHUTDOWN_TIMEOUT", env("SHUTDOWN_TIMEOUT"), &c.ShutdownTimeout},
+	})
 	if err != nil {
 		return err
 	}
 
-	jsonConf := configJSON{}
+	if v := env("RECONNECT_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%sRECONNECT_MAX_ATTEMPTS: %v", EnvPrefix, err)
+		}
+		c.ReconnectMaxAttempts = n
+	}
+
+	if v := env("DELETE_ORIGIN"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%sDELETE_ORIGIN: %v", EnvPrefix, err)
+		}
+		c.DeleteOrigin = b
+	}
+
+	if v := env("ADMIN_USERS"); v != "" {
+		c.AdminUsers = strings.Split(v, ",")
+	}
+
+	if v := env("WORKSPACE_ADMINS"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%sWORKSPACE_ADMINS: %v", EnvPrefix, err)
+		}
+		c.WorkspaceAdmins = b
+	}
+
+	if v := env("COMMAND_MENTION_ONLY"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%sCOMMAND_MENTION_ONLY: %v", EnvPrefix, err)
+		}
+		c.CommandMentionOnly = b
+	}
+
+	if v := env("PUBLIC_REPLIES"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%sPUBLIC_REPLIES: %v", EnvPrefix, err)
+		}
+		c.PublicReplies = b
+	}
+
+	if v := env("CHANNEL"); v != "" {
+		groups, err := ParseRelayGroups(v)
+		if err != nil {
+			return fmt.Errorf("%sCHANNEL: %v", EnvPrefix, err)
+		}
+		c.RelayGroups = groups
+	}
+
+	return nil
+}
 
-	if err = json.Unmarshal(buf, &jsonConf); err != nil {
+// ReadTokenFile set token from TokenFile if it's given.
+// Surrounding spaces and newline of the file are trimmed.
+func (c *Config) ReadTokenFile() error {
+	if c.TokenFile == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(c.TokenFile)
+	if err != nil {
 		return err
 	}
-	c.Token = jsonConf.Token
-	c.RelayRooms = make(map[string]struct{}, len(jsonConf.RelayRooms))
+	token := strings.TrimSpace(string(buf))
+	if token == "" {
+		return fmt.Errorf("Token file %s is empty", c.TokenFile)
+	}
+	c.Token = token
+	return nil
+}
+
+// Validate check required options and their values
+func (c *Config) Validate() error {
+	if c.Token == "" {
+		return errors.New("Token is empty")
+	}
+
+	if len(c.RelayGroups) < 1 {
+		return errors.New("No relay group")
+	}
+
+	names := make([]string, 0, len(c.RelayGroups))
+	for name := range c.RelayGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rooms := c.RelayGroups[name]
+		if len(rooms) < 2 {
+			return fmt.Errorf("Invalid room count in group %s", name)
+		}
+		ids := make([]string, 0, len(rooms))
+		for id := range rooms {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if !channelIDPattern.MatchString(id) {
+				return fmt.Errorf("Invalid channel id %q in group %s, expected id like C0123ABCD", id, name)
+			}
+		}
+	}
+
+	if c.ControlChannel != "" && !channelIDPattern.MatchString(c.ControlChannel) {
+		return fmt.Errorf("Invalid control channel id %q, expected id like C0123ABCD", c.ControlChannel)
+	}
+
+	for _, id := range c.AdminUsers {
+		if !userIDPattern.MatchString(id) {
+			return fmt.Errorf("Invalid admin user id %q, expected id like U0123ABCD", id)
+		}
+	}
+
+	if strings.ContainsAny(c.CommandPrefix, " \t\n") {
+		return fmt.Errorf("Invalid command prefix %q, it must be a word", c.CommandPrefix)
+	}
+
+	if c.OutboxPath != "" && c.MessageLogPath == "" {
+		// replayed edits, deletions and reactions find relayed copies in message log
+		return errors.New("Outbox requires message log, relayed message ids are lost by restart without it")
+	}
+
+	if c.ReconnectMaxAttempts < 0 {
+		return fmt.Errorf("Invalid reconnect max attempts %d", c.ReconnectMaxAttempts)
+	}
+
+	if c.ReconnectMaxWait != 0 && c.ReconnectMaxWait < c.ReconnectMinWait {
+		return errors.New("Reconnect max wait is shorter than min wait")
+	}
 
-	for _, r := range jsonConf.RelayRooms {
-		c.RelayRooms[r] = struct{}{}
+	switch c.Transport {
+	case "", TransportRTM:
+	case TransportSocketMode:
+		if c.AppToken == "" {
+			return errors.New("App token is empty")
+		}
+	case TransportEventsAPI:
+		if c.SigningSecret == "" {
+			return errors.New("Signing secret is empty")
+		}
+		if c.EventsAddr == "" {
+			return errors.New("Events address is empty")
+		}
+	default:
+		return fmt.Errorf("Unknown transport %s", c.Transport)
 	}
 
 	return nil
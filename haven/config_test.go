@@ -0,0 +1,194 @@
+package haven
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, dir, name, content string) string {
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestConfigLoadFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haven-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.json": `{"token": "xoxb", "relay-rooms": ["C01", "C02:send-only"], "relay-groups": {"news": ["C03", "C04"]}, "message-retention": "72h", "reconnect-max-attempts": 3}`,
+		"config.yaml": `
+token: xoxb
+relay-rooms: [C01, "C02:send-only"]
+relay-groups:
+  news: [C03, C04]
+message-retention: 72h
+reconnect-max-attempts: 3
+`,
+		"config.toml": `
+token = "xoxb"
+relay-rooms = ["C01", "C02:send-only"]
+message-retention = "72h"
+reconnect-max-attempts = 3
+
+[relay-groups]
+news = ["C03", "C04"]
+`,
+	}
+	expected := Config{
+		Token: "xoxb",
+		RelayGroups: map[string]map[string]RelayDirection{
+			DefaultGroupName: {"C01": Bidirectional, "C02": SendOnly},
+			"news":           {"C03": Bidirectional, "C04": Bidirectional},
+		},
+		MessageRetention:     time.Hour * 72,
+		ReconnectMaxAttempts: 3,
+	}
+	for name, content := range files {
+		c := Config{}
+		if err := ConfigLoadFromFile(&c, writeConfigFile(t, dir, name, content)); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, expected) {
+			t.Errorf("%s: Expected %+v. Actual: %+v", name, expected, c)
+		}
+	}
+
+	if err := ConfigLoadFromFile(&Config{}, filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expected error for missing config file")
+	}
+}
+
+func TestConfigLoadFromFileUnknownKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haven-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.json": `{"token": "xoxb", "relay_rooms": ["C01", "C02"]}`,
+		"config.yml":  "token: xoxb\nrelay_rooms: [C01, C02]\n",
+		"config.toml": "token = \"xoxb\"\nrelay_rooms = [\"C01\", \"C02\"]\n",
+	}
+	for name, content := range files {
+		err := ConfigLoadFromFile(&Config{}, writeConfigFile(t, dir, name, content))
+		if err == nil || !strings.Contains(err.Error(), "relay_rooms") {
+			t.Errorf("%s: Expected unknown key error. Actual: %v", name, err)
+		}
+	}
+
+	err = ConfigLoadFromFile(&Config{}, writeConfigFile(t, dir, "bad.json", `{"shutdown-timeout": "soon"}`))
+	if err == nil || !strings.Contains(err.Error(), "shutdown-timeout") {
+		t.Errorf("Expected duration error names the key. Actual: %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			Token:       "xoxb",
+			RelayGroups: map[string]map[string]RelayDirection{"a": {"C01": Bidirectional, "G02": Bidirectional}},
+		}
+	}
+	if err := valid().Validate(); err != nil {
+		t.Errorf("Expected valid. Actual: %v", err)
+	}
+
+	cases := []struct {
+		modify   func(c *Config)
+		expected string
+	}{
+		{func(c *Config) { c.Token = "" }, "Token is empty"},
+		{func(c *Config) { c.RelayGroups = nil }, "No relay group"},
+		{func(c *Config) { delete(c.RelayGroups["a"], "G02") }, "Invalid room count in group a"},
+		{func(c *Config) { c.RelayGroups["a"]["general"] = Bidirectional }, `Invalid channel id "general" in group a`},
+		{func(c *Config) { c.AdminUsers = []string{"alice"} }, `Invalid admin user id "alice"`},
+		{func(c *Config) { c.OutboxPath = "outbox" }, "Outbox requires message log"},
+		{func(c *Config) { c.ReconnectMaxAttempts = -1 }, "Invalid reconnect max attempts"},
+		{func(c *Config) { c.Transport = TransportSocketMode }, "App token is empty"},
+		{func(c *Config) { c.Transport = "smoke" }, "Unknown transport smoke"},
+	}
+	for _, cs := range cases {
+		c := valid()
+		cs.modify(c)
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), cs.expected) {
+			t.Errorf("Expected %q. Actual: %v", cs.expected, err)
+		}
+	}
+}
+
+func TestConfigLoadFromEnv(t *testing.T) {
+	env := map[string]string{
+		"SLACK_HAVEN_TOKEN":                  "xoxb-env",
+		"SLACK_HAVEN_CHANNEL":                "a=C01:send-only,C02",
+		"SLACK_HAVEN_MESSAGE_LOG":            "/var/lib/haven/log",
+		"SLACK_HAVEN_MESSAGE_RETENTION":      "24h",
+		"SLACK_HAVEN_RECONNECT_MAX_ATTEMPTS": "5",
+		"SLACK_HAVEN_DELETE_ORIGIN":          "true",
+		"SLACK_HAVEN_TRANSPORT":              TransportSocketMode,
+		"SLACK_HAVEN_APP_TOKEN":              "xapp-env",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	c := Config{Token: "xoxb-file", TokenFile: "/run/secrets/token", OutboxPath: "outbox"}
+	if err := ConfigLoadFromEnv(&c); err != nil {
+		t.Fatal(err)
+	}
+	expected := Config{
+		Token:                "xoxb-env",
+		RelayGroups:          map[string]map[string]RelayDirection{"a": {"C01": SendOnly, "C02": Bidirectional}},
+		MessageLogPath:       "/var/lib/haven/log",
+		MessageRetention:     time.Hour * 24,
+		OutboxPath:           "outbox",
+		ReconnectMaxAttempts: 5,
+		DeleteOrigin:         true,
+		Transport:            TransportSocketMode,
+		AppToken:             "xapp-env",
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("Expected %+v. Actual: %+v", expected, c)
+	}
+
+	os.Setenv("SLACK_HAVEN_RECONNECT_MAX_ATTEMPTS", "many")
+	err := ConfigLoadFromEnv(&c)
+	if err == nil || !strings.Contains(err.Error(), "SLACK_HAVEN_RECONNECT_MAX_ATTEMPTS") {
+		t.Errorf("Expected error names the variable. Actual: %v", err)
+	}
+}
+
+func TestConfigReadTokenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haven-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := Config{Token: "xoxb-file", TokenFile: writeConfigFile(t, dir, "token", "xoxb-secret\n")}
+	if err := c.ReadTokenFile(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Token != "xoxb-secret" {
+		t.Errorf("Expected token from file. Actual: %q", c.Token)
+	}
+
+	c.TokenFile = writeConfigFile(t, dir, "empty", "\n")
+	if err := c.ReadTokenFile(); err == nil {
+		t.Error("Expected error for empty token file")
+	}
+}
@@ -0,0 +1,121 @@
+package haven
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReconnectMinWait is first wait before retrying connection
+	DefaultReconnectMinWait = time.Second
+	// DefaultReconnectMaxWait is max wait between connection attempts
+	DefaultReconnectMaxWait = time.Minute * 5
+)
+
+// ConnectionState is state of connection to slack
+type ConnectionState int
+
+const (
+	// StateConnecting is trying to connect
+	StateConnecting ConnectionState = iota
+	// StateConnected is receiving events
+	StateConnected
+	// StateDegraded is waiting to retry after connection attempts failed
+	StateDegraded
+	// StateStopped is shut down or given up connecting by max attempts
+	StateStopped
+)
+
+var connectionStateNames = map[ConnectionState]string{
+	StateConnecting: "connecting",
+	StateConnected:  "connected",
+	StateDegraded:   "degraded",
+	StateStopped:    "stopped",
+}
+
+func (s ConnectionState) String() string {
+	return connectionStateNames[s]
+}
+
+// ConnectionStatus is snapshot of connection state
+type ConnectionStatus struct {
+	State ConnectionState
+	// Since is when the state is entered
+	Since time.Time
+	// Attempts is failed connection attempts since last connected
+	Attempts int
+	// LastError is error of last failed attempt
+	LastError error
+}
+
+// connectionTracker keeps connection state shared with api callers
+type connectionTracker struct {
+	mu     sync.Mutex
+	status ConnectionStatus
+}
+
+func newConnectionTracker() *connectionTracker {
+	return &connectionTracker{status: ConnectionStatus{State: StateConnecting, Since: time.Now()}}
+}
+
+func (t *connectionTracker) get() ConnectionStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// set state. err is nil unless an attempt failed.
+func (t *connectionTracker) set(state ConnectionState, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if state != t.status.State {
+		logger.Infof("connection state %v -> %v", t.status.State, state)
+		t.status.State = state
+		t.status.Since = time.Now()
+	}
+	switch {
+	case state == StateConnected:
+		t.status.Attempts = 0
+		t.status.LastError = nil
+	case err != nil:
+		t.status.Attempts++
+		t.status.LastError = err
+	}
+}
+
+// backoff is exponential backoff with jitter.
+// Each wait is randomized between half and full of doubled wait.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt uint
+	random  func() float64
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if min <= 0 {
+		min = DefaultReconnectMinWait
+	}
+	if max <= 0 {
+		max = DefaultReconnectMaxWait
+	}
+	if max < min {
+		max = min
+	}
+	return &backoff{min: min, max: max, random: rand.Float64}
+}
+
+// next return wait before next attempt
+func (b *backoff) next() time.Duration {
+	wait := b.min
+	for i := uint(0); i < b.attempt && wait < b.max; i++ {
+		wait *= 2
+	}
+	if wait > b.max {
+		wait = b.max
+	}
+	b.attempt++
+	half := wait / 2
+	return half + time.Duration(b.random()*float64(wait-half))
+}
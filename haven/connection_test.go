@@ -0,0 +1,67 @@
+package haven
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, time.Second*10)
+	b.random = func() float64 { return 1 }
+	waits := []time.Duration{}
+	for i := 0; i < 6; i++ {
+		waits = append(waits, b.next())
+	}
+	expected := []time.Duration{
+		time.Second, time.Second * 2, time.Second * 4, time.Second * 8, time.Second * 10, time.Second * 10,
+	}
+	if !reflect.DeepEqual(waits, expected) {
+		t.Errorf("Expected waits %v. Actual: %v", expected, waits)
+	}
+
+	// jitter is at least half of the wait
+	b = newBackoff(time.Second, time.Second*10)
+	b.random = func() float64 { return 0 }
+	b.next()
+	if wait := b.next(); wait != time.Second {
+		t.Errorf("Expected minimum jitter 1s. Actual: %v", wait)
+	}
+
+	// default waits grow up to default max
+	b = newBackoff(0, 0)
+	b.random = func() float64 { return 1 }
+	waits = waits[:0]
+	for i := 0; i < 11; i++ {
+		waits = append(waits, b.next())
+	}
+	expected = []time.Duration{
+		time.Second, time.Second * 2, time.Second * 4, time.Second * 8, time.Second * 16, time.Second * 32,
+		time.Second * 64, time.Second * 128, time.Second * 256, time.Minute * 5, time.Minute * 5,
+	}
+	if !reflect.DeepEqual(waits, expected) {
+		t.Errorf("Expected default waits %v. Actual: %v", expected, waits)
+	}
+}
+
+func TestConnectionTracker(t *testing.T) {
+	c := newConnectionTracker()
+	if s := c.get(); s.State != StateConnecting {
+		t.Errorf("Expected connecting at first. Actual: %v", s.State)
+	}
+
+	c.set(StateDegraded, errors.New("failed"))
+	c.set(StateConnecting, nil)
+	c.set(StateDegraded, errors.New("failed again"))
+	s := c.get()
+	if s.State != StateDegraded || s.Attempts != 2 || s.LastError.Error() != "failed again" {
+		t.Errorf("Unexpected status %+v", s)
+	}
+
+	c.set(StateConnected, nil)
+	s = c.get()
+	if s.State != StateConnected || s.Attempts != 0 || s.LastError != nil || s.State.String() != "connected" {
+		t.Errorf("Unexpected status %+v", s)
+	}
+}
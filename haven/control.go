@@ -0,0 +1,99 @@
+package haven
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseRelayChannelArg parse "ID[:direction]" argument, ID may be a channel mention
+func parseRelayChannelArg(arg string) (string, RelayDirection, error) {
+	id, dir, err := ParseRelayRoom(arg)
+	if err != nil {
+		return "", dir, err
+	}
+	id = parseChannelMention(id)
+	if !channelIDPattern.MatchString(id) {
+		return "", dir, fmt.Errorf("Invalid channel id %q", id)
+	}
+	return id, dir, nil
+}
+
+// addRelayChannel handle "haven add <channel>[:direction] [group]"
+func (b *RelayBot) addRelayChannel(req *commandRequest) (string, error) {
+	args := req.args
+	id, dir, err := parseRelayChannelArg(args[0])
+	if err != nil {
+		return "", err
+	}
+	name := DefaultGroupName
+	if len(args) == 2 {
+		name = args[1]
+	}
+	if err := b.state.add(name, id, dir); err != nil {
+		return "", err
+	}
+	b.applyRelayState()
+	reply := fmt.Sprintf("Added <#%s> to group %s as %v", id, name, dir)
+	if !b.relayGroups[name].hasChannel(id) {
+		reply += ". Invite this bot to the channel to start relaying"
+	}
+	return reply, nil
+}
+
+// removeRelayChannel handle "haven remove <channel> [group]".
+// The channel is removed from all groups if group is omitted.
+func (b *RelayBot) removeRelayChannel(req *commandRequest) (string, error) {
+	args := req.args
+	id := parseChannelMention(args[0])
+	names := []string{}
+	for name, rooms := range b.config.RelayGroups {
+		if _, ok := rooms[id]; ok && (len(args) == 1 || args[1] == name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("%s is not relayed", args[0])
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := b.state.remove(name, id); err != nil {
+			return "", err
+		}
+	}
+	b.applyRelayState()
+	return fmt.Sprintf("Removed <#%s> from group %s", id, strings.Join(names, ", ")), nil
+}
+
+// relayChannelList handle "haven list"
+func (b *RelayBot) relayChannelList() string {
+	buf := bytes.Buffer{}
+	buf.WriteString("```\n")
+	if b.state.paused() {
+		buf.WriteString("Relaying is paused\n")
+	}
+	names := make([]string, 0, len(b.config.RelayGroups))
+	for name := range b.config.RelayGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "Group %s\n", name)
+		rooms := b.config.RelayGroups[name]
+		ids := make([]string, 0, len(rooms))
+		for id := range rooms {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			joined := ""
+			if !b.relayGroups[name].hasChannel(id) {
+				joined = " (not joined)"
+			}
+			fmt.Fprintf(&buf, "  %s %v%s\n", id, rooms[id], joined)
+		}
+	}
+	buf.WriteString("```\n")
+	return buf.String()
+}
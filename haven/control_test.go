@@ -0,0 +1,107 @@
+package haven
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAdminCommand(t *testing.T) {
+	replies := []string{}
+	api, _, closer := newTestAPIClient(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/conversations.members":
+			if r.URL.Query().Get("channel") == "C09" {
+				w.Write([]byte(`{"ok": false, "error": "not_in_channel"}`))
+				return
+			}
+			w.Write([]byte(`{"ok": true, "members": ["A"]}`))
+		case "/users.info":
+			w.Write([]byte(`{"ok": true, "user": {"id": "A", "name": "alice"}}`))
+		case "/chat.postEphemeral":
+			pe := postEphemeralRequest{}
+			json.NewDecoder(r.Body).Decode(&pe)
+			replies = append(replies, pe.Text)
+			w.Write([]byte(`{"ok": true}`))
+		case "/chat.postMessage":
+			pm := postMessageRequest{}
+			json.NewDecoder(r.Body).Decode(&pm)
+			replies = append(replies, pm.Text)
+			w.Write([]byte(`{"ok": true, "ts": "1.000001"}`))
+		default:
+			t.Errorf("Unexpected api call %v", r.URL.Path)
+		}
+	})
+	defer closer()
+
+	cfg := &Config{
+		ControlChannel: "C00",
+		RelayGroups:    map[string]map[string]RelayDirection{"a": {"C01": Bidirectional, "C02": Bidirectional}},
+	}
+	state, cleanup := openTestRelayState(t)
+	defer cleanup()
+	lastSeen, _ := openLastSeen("")
+	b := &RelayBot{
+		config:       cfg,
+		configGroups: cfg.RelayGroups,
+		relayGroups:  newRelayGroups(cfg, []channel{{ID: "C01"}, {ID: "C02"}}),
+		api:          api,
+		users:        newUserCache(api.fetchUserInfo),
+		state:        state,
+		lastSeen:     lastSeen,
+	}
+	command := func(text string) string {
+		replies = replies[:0]
+		b.handleMessage(&message{Channel: "C00", User: "A", Text: text})
+		if len(replies) != 1 {
+			t.Fatalf("Expected a reply to %q. Actual: %v", text, replies)
+		}
+		return replies[0]
+	}
+
+	if reply := command("haven add <#C03|news>:receive-only a"); !strings.Contains(reply, "Added <#C03> to group a as receive-only") {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	if b.relayGroups["a"]["C03"].direction != ReceiveOnly {
+		t.Errorf("Expected C03 is relayed. Actual: %v", b.relayGroups)
+	}
+	if reply := command("haven add C09 b"); !strings.Contains(reply, "Invite this bot") {
+		t.Errorf("Expected invite notice. Actual: %q", reply)
+	}
+	if reply := command("haven remove C02"); reply != "Removed <#C02> from group a" {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	if b.relayGroups.hasChannel("C02") {
+		t.Error("Expected C02 is removed")
+	}
+	if reply := command("haven remove C02"); !strings.HasPrefix(reply, "Error:") {
+		t.Errorf("Expected error for not relayed channel. Actual: %q", reply)
+	}
+	if reply := command("haven add general"); !strings.Contains(reply, `Invalid channel id "general"`) {
+		t.Errorf("Expected invalid channel error. Actual: %q", reply)
+	}
+
+	command("haven pause")
+	if reply := command("haven list"); !strings.Contains(reply, "paused") || !strings.Contains(reply, "C09 bidirectional (not joined)") {
+		t.Errorf("Unexpected list %q", reply)
+	}
+	if relayTo := b.relayGroups.determineRelayChannels("C01"); len(relayTo) == 0 {
+		t.Fatal("Expected relay channels")
+	}
+	b.handleMessage(&message{Channel: "C01", User: "A", Text: "hello", Ts: "1.000002"})
+	if len(replies) != 1 {
+		t.Errorf("Expected nothing is relayed while paused. Actual: %v", replies)
+	}
+	command("haven resume")
+	if b.state.paused() {
+		t.Error("Expected resumed")
+	}
+
+	// admin commands are accepted only in control channel
+	replies = replies[:0]
+	b.handleMessage(&message{Channel: "C01", User: "A", Text: "haven pause"})
+	if b.state.paused() || len(replies) != 1 || !strings.Contains(replies[0], "not permitted") {
+		t.Errorf("Expected command outside control channel is denied. %v", replies)
+	}
+}
@@ -0,0 +1,197 @@
+package haven
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DeliveryQueueSize is max pending tasks of a destination channel.
+// Enqueueing blocks when the queue is full.
+const DeliveryQueueSize = 100
+
+const (
+	// DeliveryRetryWait is first wait before retrying a task failed temporarily
+	DeliveryRetryWait = time.Second
+	// MaxDeliveryRetryWait is max wait between retries
+	MaxDeliveryRetryWait = time.Minute
+)
+
+// deliveryTask is an api call applied to a destination channel
+type deliveryTask struct {
+	kind     string // outbox entry kind
+	run      func() error
+	enqueued time.Time
+}
+
+// deliveryStats is backpressure metrics of a destination channel
+type deliveryStats struct {
+	Channel   string
+	Depth     int           // pending tasks
+	Delivered uint64        // succeeded tasks
+	Failed    uint64        // failed tasks
+	Retried   uint64        // retries of temporary failures
+	Blocked   uint64        // enqueues waited for full queue
+	Latency   time.Duration // last latency from enqueue to done
+}
+
+// channelQueue runs tasks of a destination channel in order
+type channelQueue struct {
+	tasks chan deliveryTask
+	stats deliveryStats
+}
+
+// deliverer has a worker per destination channel.
+// Tasks for a channel are applied in enqueued order.
+// Temporary failures are retried until succeeded, later tasks wait for it.
+type deliverer struct {
+	mu           sync.Mutex
+	queues       map[string]*channelQueue
+	size         int
+	retryWait    time.Duration
+	maxRetryWait time.Duration
+	workers      sync.WaitGroup
+	closed       bool          // enqueue is refused after drain
+	stop         chan struct{} // closed when drain is timed out
+}
+
+func newDeliverer(size int) *deliverer {
+	return &deliverer{
+		queues:       map[string]*channelQueue{},
+		size:         size,
+		retryWait:    DeliveryRetryWait,
+		maxRetryWait: MaxDeliveryRetryWait,
+		stop:         make(chan struct{}),
+	}
+}
+
+// queue return queue of the channel, start worker if not exists
+func (d *deliverer) queue(channelID string) *channelQueue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q, ok := d.queues[channelID]
+	if !ok {
+		q = &channelQueue{
+			tasks: make(chan deliveryTask, d.size),
+			stats: deliveryStats{Channel: channelID},
+		}
+		d.queues[channelID] = q
+		d.workers.Add(1)
+		go d.work(q)
+	}
+	return q
+}
+
+// enqueue a task to the channel. It blocks while the queue is full.
+// Tasks are dropped after drain.
+func (d *deliverer) enqueue(channelID, kind string, run func() error) {
+	d.mu.Lock()
+	closed := d.closed
+	d.mu.Unlock()
+	if closed {
+		logger.Warnf("delivery is stopped, drop %s to %s", kind, channelID)
+		return
+	}
+	q := d.queue(channelID)
+	task := deliveryTask{kind: kind, run: run, enqueued: time.Now()}
+	select {
+	case q.tasks <- task:
+	default:
+		d.mu.Lock()
+		q.stats.Blocked++
+		d.mu.Unlock()
+		logger.Warnf("delivery queue of %s is full", channelID)
+		q.tasks <- task
+	}
+}
+
+func (d *deliverer) work(q *channelQueue) {
+	defer d.workers.Done()
+	for task := range q.tasks {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		err := d.run(q, task)
+		d.mu.Lock()
+		if err != nil {
+			q.stats.Failed++
+		} else {
+			q.stats.Delivered++
+		}
+		q.stats.Latency = time.Since(task.enqueued)
+		d.mu.Unlock()
+		if err != nil {
+			logger.Warnf("cant deliver %s to %s: %v", task.kind, q.stats.Channel, err)
+		}
+	}
+}
+
+// run a task, retry while it fails temporarily
+func (d *deliverer) run(q *channelQueue, task deliveryTask) error {
+	wait := d.retryWait
+	for {
+		err := task.run()
+		if err == nil || !isTemporary(err) {
+			return err
+		}
+		logger.Warnf("cant deliver %s to %s, retry after %v: %v", task.kind, q.stats.Channel, wait, err)
+		d.mu.Lock()
+		q.stats.Retried++
+		d.mu.Unlock()
+		select {
+		case <-time.After(wait):
+		case <-d.stop:
+			return err
+		}
+		wait *= 2
+		if wait > d.maxRetryWait {
+			wait = d.maxRetryWait
+		}
+	}
+}
+
+// drain stop accepting tasks and wait for queued tasks until timeout.
+// It must not be called with enqueue concurrently.
+// Tasks left by timeout are abandoned, the outbox keeps them.
+func (d *deliverer) drain(timeout time.Duration) error {
+	d.mu.Lock()
+	d.closed = true
+	for _, q := range d.queues {
+		close(q.tasks)
+	}
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		close(d.stop)
+		left := 0
+		for _, s := range d.stats() {
+			left += s.Depth
+		}
+		return fmt.Errorf("delivery is timed out, %d tasks are left", left)
+	}
+}
+
+// stats return metrics of all queues sorted by channel id
+func (d *deliverer) stats() []deliveryStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := make([]deliveryStats, 0, len(d.queues))
+	for _, q := range d.queues {
+		s := q.stats
+		s.Depth = len(q.tasks)
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Channel < stats[j].Channel })
+	return stats
+}
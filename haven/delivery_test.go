@@ -0,0 +1,251 @@
+package haven
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitDelivered wait until count tasks are done in all queues
+func waitDelivered(d *deliverer, count uint64) []deliveryStats {
+	for i := 0; i < 100; i++ {
+		var done uint64
+		stats := d.stats()
+		for _, s := range stats {
+			done += s.Delivered + s.Failed
+		}
+		if done >= count {
+			return stats
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return d.stats()
+}
+
+func TestDelivererOrder(t *testing.T) {
+	d := newDeliverer(1)
+	mu := sync.Mutex{}
+	done := map[string][]int{}
+
+	// block channel 1 worker for a while, so enqueues to channel 1 wait
+	release := make(chan struct{})
+	d.enqueue("1", "post", func() error {
+		<-release
+		return nil
+	})
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		close(release)
+	}()
+
+	for i := 0; i < 5; i++ {
+		for _, ch := range []string{"1", "2"} {
+			i, ch := i, ch
+			d.enqueue(ch, "post", func() error {
+				mu.Lock()
+				defer mu.Unlock()
+				done[ch] = append(done[ch], i)
+				if i == 4 {
+					return errors.New("failed")
+				}
+				return nil
+			})
+		}
+	}
+
+	stats := waitDelivered(d, 11)
+
+	mu.Lock()
+	expected := []int{0, 1, 2, 3, 4}
+	if !reflect.DeepEqual(done["1"], expected) || !reflect.DeepEqual(done["2"], expected) {
+		t.Errorf("Expected tasks are applied in order. Actual: %v", done)
+	}
+	mu.Unlock()
+
+	if len(stats) != 2 || stats[0].Channel != "1" || stats[1].Channel != "2" {
+		t.Fatalf("Expected stats of 2 channels. Actual: %+v", stats)
+	}
+	if stats[0].Delivered != 5 || stats[0].Failed != 1 || stats[0].Blocked == 0 {
+		t.Errorf("Unexpected stats of channel 1. %+v", stats[0])
+	}
+	if stats[1].Delivered != 4 || stats[1].Failed != 1 {
+		t.Errorf("Unexpected stats of channel 2. %+v", stats[1])
+	}
+}
+
+func TestDelivererRetry(t *testing.T) {
+	d := newDeliverer(1)
+	d.retryWait = time.Millisecond
+	attempts := 0
+	d.enqueue("1", "post", func() error {
+		attempts++
+		if attempts < 3 {
+			return &HTTPError{Method: "chat.postMessage", StatusCode: 503}
+		}
+		return nil
+	})
+	d.enqueue("1", "post", func() error {
+		return &APIError{Method: "chat.postMessage", Code: "channel_not_found"}
+	})
+
+	stats := waitDelivered(d, 2)
+	if len(stats) != 1 || stats[0].Delivered != 1 || stats[0].Failed != 1 || stats[0].Retried != 2 {
+		t.Errorf("Expected temporary failures are retried. Actual: %+v", stats)
+	}
+}
+
+func TestDelivererDrain(t *testing.T) {
+	d := newDeliverer(10)
+	mu := sync.Mutex{}
+	done := 0
+	for i := 0; i < 5; i++ {
+		d.enqueue("1", "post", func() error {
+			time.Sleep(time.Millisecond * 10)
+			mu.Lock()
+			done++
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := d.drain(time.Second); err != nil {
+		t.Errorf("Expected all tasks are drained. %v", err)
+	}
+	mu.Lock()
+	if done != 5 {
+		t.Errorf("Expected 5 tasks are done. Actual: %v", done)
+	}
+	mu.Unlock()
+
+	// enqueue after drain is dropped
+	d.enqueue("2", "post", func() error {
+		t.Error("Task after drain is run")
+		return nil
+	})
+}
+
+func TestDelivererDrainTimeout(t *testing.T) {
+	d := newDeliverer(10)
+	d.retryWait = time.Hour
+	d.enqueue("1", "post", func() error {
+		return &HTTPError{Method: "chat.postMessage", StatusCode: 503}
+	})
+	d.enqueue("1", "post", func() error {
+		t.Error("Task after timeout is run")
+		return nil
+	})
+	if err := d.drain(time.Millisecond * 50); err == nil {
+		t.Error("Expected drain is timed out")
+	}
+	// worker exits by stop
+	d.workers.Wait()
+}
+
+func TestDeliverDeleteRetry(t *testing.T) {
+	mu := sync.Mutex{}
+	deletes := 0
+	api, _, closer := newTestAPIClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat.delete" {
+			t.Errorf("Unexpected api call %v", r.URL.Path)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		deletes++
+		if deletes == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"ok": true}`))
+	})
+	defer closer()
+	// rate limit is retried by deliverer
+	api.maxRetries = 0
+
+	cfg := &Config{DeleteOrigin: true, RelayGroups: map[string]map[string]RelayDirection{
+		"a": {"1": Bidirectional, "2": Bidirectional},
+	}}
+	outbox, _, _ := openOutbox("")
+	b := &RelayBot{
+		config:      cfg,
+		messageLog:  newMessageLog(newMemoryMessageStore(DefaultMessageLogSize)),
+		relayGroups: newRelayGroups(cfg, []channel{{ID: "1"}, {ID: "2"}}),
+		api:         api,
+		delivery:    newDeliverer(DeliveryQueueSize),
+		outbox:      outbox,
+	}
+	b.delivery.retryWait = time.Millisecond
+	b.messageLog.add("1", "100.000001", "100.000001")
+	b.messageLog.add("2", "200.000001", "100.000001")
+
+	b.handleMessageDeleted(&messageDeleted{Channel: "1", DeletedTs: "100.000001"})
+	stats := waitDelivered(b.delivery, 1)
+	if len(stats) != 1 || stats[0].Delivered != 1 || stats[0].Retried != 1 {
+		t.Errorf("Expected delete is retried. Actual: %+v", stats)
+	}
+	mu.Lock()
+	if deletes != 2 {
+		t.Errorf("Expected chat.delete is called again after rate limited. Actual: %v", deletes)
+	}
+	mu.Unlock()
+	if m := b.messageLog.getOriginMap("100.000001"); m != nil {
+		t.Errorf("Expected deleted copy is forgotten. Actual: %v", m)
+	}
+
+	// deletion event of the copy caused by this bot is ignored
+	b.handleMessageDeleted(&messageDeleted{Channel: "2", DeletedTs: "200.000001"})
+	if b.deleting.remove("2", "200.000001") {
+		t.Error("Expected deleting copy is cleared by its deletion event")
+	}
+}
+
+func TestDeliverUploadRetry(t *testing.T) {
+	mu := sync.Mutex{}
+	uploads := 0
+	api, _, closer := newTestAPIClient(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/download":
+			w.Write([]byte("png"))
+		case "/files.upload":
+			// uploaded, but response is lost
+			uploads++
+			w.WriteHeader(http.StatusBadGateway)
+		case "/conversations.history":
+			w.Write([]byte(`{"ok": true, "messages": [
+				{"type": "message", "user": "UBOT", "ts": "200.000001", "files": [{"name": "botupload-a.png", "size": 3}]}]}`))
+		default:
+			t.Errorf("Unexpected api call %v", r.URL.Path)
+		}
+	})
+	defer closer()
+	api.maxRetries = 0
+
+	outbox, _, _ := openOutbox("")
+	b := &RelayBot{
+		config:   &Config{},
+		api:      api,
+		delivery: newDeliverer(DeliveryQueueSize),
+		outbox:   outbox,
+	}
+	b.delivery.retryWait = time.Millisecond
+	b.deliver(&outboxEntry{
+		Kind:    outboxUpload,
+		Channel: "2",
+		File:    &slackFile{Name: "a.png", Size: 3, URLPrivate: strings.TrimSuffix(api.baseURL, "/") + "/download"},
+	})
+	stats := waitDelivered(b.delivery, 1)
+	if len(stats) != 1 || stats[0].Delivered != 1 || stats[0].Retried != 1 {
+		t.Errorf("Expected upload is retried. Actual: %+v", stats)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if uploads != 1 {
+		t.Errorf("Expected uploaded file is found in history and not uploaded again. Actual: %v", uploads)
+	}
+}
@@ -0,0 +1,100 @@
+package haven
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// compareTs compare slack timestamps such as 1500000000.000100.
+// It returns -1, 0 or 1 like strings.Compare.
+func compareTs(a, b string) int {
+	aSec, aFrac := splitTs(a)
+	bSec, bFrac := splitTs(b)
+	switch {
+	case aSec < bSec:
+		return -1
+	case aSec > bSec:
+		return 1
+	}
+	return strings.Compare(aFrac, bFrac)
+}
+
+func splitTs(ts string) (int64, string) {
+	parts := strings.SplitN(ts, ".", 2)
+	sec, _ := strconv.ParseInt(parts[0], 10, 64)
+	frac := "000000"
+	if len(parts) == 2 {
+		frac = (parts[1] + frac)[:len(frac)]
+	}
+	return sec, frac
+}
+
+// formatTs format time as slack timestamp
+func formatTs(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10) + ".000000"
+}
+
+// lastSeen keeps latest message ts of each relay channel.
+// It's saved to file on update if path is given.
+type lastSeen struct {
+	path string
+	mu   sync.Mutex
+	ts   map[string]string
+}
+
+func openLastSeen(path string) (*lastSeen, error) {
+	l := &lastSeen{path: path, ts: map[string]string{}}
+	if path == "" {
+		return l, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &l.ts); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// get return last seen ts of the channel. empty means unknown.
+func (l *lastSeen) get(channelID string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ts[channelID]
+}
+
+// update last seen ts of the channel if ts is newer
+func (l *lastSeen) update(channelID, ts string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.ts[channelID]; ok && compareTs(ts, last) <= 0 {
+		return nil
+	}
+	l.ts[channelID] = ts
+	return l.save()
+}
+
+// save write all ts to file. It's replaced atomically.
+func (l *lastSeen) save() error {
+	if l.path == "" {
+		return nil
+	}
+	buf, err := json.Marshal(l.ts)
+	if err != nil {
+		return err
+	}
+	tmpPath := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, l.path)
+}
@@ -0,0 +1,54 @@
+package haven
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareTs(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1500000000.000100", "1500000000.000100", 0},
+		{"1500000000.000100", "1500000000.000099", 1},
+		{"999999999.999999", "1500000000.000000", -1},
+		{"1500000000", "1500000000.000000", 0},
+		{"1500000000.1", "1500000000.000001", 1},
+	}
+	for _, c := range cases {
+		if actual := compareTs(c.a, c.b); actual != c.expected {
+			t.Errorf("compareTs(%v, %v) Expected %v. Actual: %v", c.a, c.b, c.expected, actual)
+		}
+	}
+}
+
+func TestLastSeen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "last-seen")
+
+	l, err := openLastSeen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.update("1", "100.000002")
+	l.update("1", "100.000001")
+	l.update("2", "99.000000")
+	if ts := l.get("1"); ts != "100.000002" {
+		t.Errorf("Expected older ts is ignored. Actual: %v", ts)
+	}
+
+	l, err = openLastSeen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.get("1") != "100.000002" || l.get("2") != "99.000000" || l.get("3") != "" {
+		t.Errorf("Unexpected last seen after reopen %v", l.ts)
+	}
+}
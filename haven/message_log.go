@@ -2,13 +2,18 @@ package haven
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
+// DefaultMessageLogSize is record count of in-memory message store
+const DefaultMessageLogSize = 100
+
 // MessageMap contains same message which posted to relaing channels.
 // key means posted channel. value means message id.
 type messageMap struct {
 	originChannelID string
 	originID        string
+	created         int64 // unix time of origin message added
 	mmap            map[string]string
 }
 
@@ -20,53 +25,265 @@ func newMessageMap(channelID, messageID string) messageMap {
 	}
 }
 
+// copyMap return copy of channel to message id map
+func (m messageMap) copyMap() map[string]string {
+	c := make(map[string]string, len(m.mmap))
+	for k, v := range m.mmap {
+		c[k] = v
+	}
+	return c
+}
+
+// messageStore is storage of message maps.
+// Implementations need not be goroutine safe, messageLog serializes calls.
+type messageStore interface {
+	// add message. message is a origin when messageID equals originID.
+	add(channelID, messageID, originID string) error
+	// find message map which contains the message. nil if not found.
+	find(channelID, messageID string) (*messageMap, error)
+	// findByOrigin find message map by origin message id. nil if not found.
+	findByOrigin(originID string) (*messageMap, error)
+	// forget a message. message map is dropped when it becomes empty.
+	forget(channelID, messageID string) error
+	// size return count of message maps
+	size() int
+	// close release storage resources
+	close() error
+}
+
 // MessageLog is sent message container.
 type messageLog struct {
-	records []messageMap
-	mu      sync.RWMutex
+	// lookup results, accessed atomically
+	hits   uint64
+	misses uint64
+	store  messageStore
+	mu     sync.RWMutex
 }
 
 // NewMessageLog create message log
-func newMessageLog(size int) *messageLog {
+func newMessageLog(store messageStore) *messageLog {
 	return &messageLog{
-		records: make([]messageMap, 0, size),
-		mu:      sync.RWMutex{},
+		store: store,
+		mu:    sync.RWMutex{},
+	}
+}
+
+// newMessageLogFromConfig create message log with the store which config specifies
+func newMessageLogFromConfig(config *Config) (*messageLog, error) {
+	if config.MessageLogPath == "" {
+		return newMessageLog(newMemoryMessageStore(DefaultMessageLogSize)), nil
+	}
+	store, err := openFileMessageStore(config.MessageLogPath, config.MessageRetention)
+	if err != nil {
+		return nil, err
 	}
+	return newMessageLog(store), nil
+}
+
+// lookup count a lookup result
+func (l *messageLog) lookup(found bool) {
+	if found {
+		atomic.AddUint64(&l.hits, 1)
+	} else {
+		atomic.AddUint64(&l.misses, 1)
+	}
+}
+
+// lookups return hit and miss count of lookups
+func (l *messageLog) lookups() (uint64, uint64) {
+	return atomic.LoadUint64(&l.hits), atomic.LoadUint64(&l.misses)
+}
+
+// size return count of message maps
+func (l *messageLog) size() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.store.size()
 }
 
 // Add message log
 func (l *messageLog) add(channelID, messageID, originID string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if err := l.store.add(channelID, messageID, originID); err != nil {
+		logger.Warnf("message log: %v", err)
+	}
+}
+
+func (l *messageLog) getMessageMap(channelID, messageID string) map[string]string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	record, err := l.store.find(channelID, messageID)
+	if err != nil {
+		logger.Warnf("message log: %v", err)
+		return nil
+	}
+	l.lookup(record != nil)
+	if record == nil {
+		return nil
+	}
+	return record.copyMap()
+}
+
+// originOf return origin message id of the message. empty if not found.
+func (l *messageLog) originOf(channelID, messageID string) string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	record, err := l.store.find(channelID, messageID)
+	if err != nil {
+		logger.Warnf("message log: %v", err)
+		return ""
+	}
+	l.lookup(record != nil)
+	if record == nil {
+		return ""
+	}
+	return record.originID
+}
+
+// isOrigin tests the message is origin of relayed messages
+func (l *messageLog) isOrigin(channelID, messageID string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	record, err := l.store.find(channelID, messageID)
+	if err != nil {
+		logger.Warnf("message log: %v", err)
+		return false
+	}
+	return record != nil && record.originChannelID == channelID && record.originID == messageID
+}
+
+// getOriginMap return message map of the origin message id
+func (l *messageLog) getOriginMap(originID string) map[string]string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	record, err := l.store.findByOrigin(originID)
+	if err != nil {
+		logger.Warnf("message log: %v", err)
+		return nil
+	}
+	l.lookup(record != nil)
+	if record == nil {
+		return nil
+	}
+	return record.copyMap()
+}
+
+// forget a message, so events of the message are no longer relayed
+func (l *messageLog) forget(channelID, messageID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.store.forget(channelID, messageID); err != nil {
+		logger.Warnf("message log: %v", err)
+	}
+}
+
+// deletingSet keeps relayed copies being deleted by this bot,
+// so deletion events caused by this bot are ignored. Zero value is ready to use.
+type deletingSet struct {
+	mu  sync.Mutex
+	ids map[string]struct{}
+}
+
+func deletingKey(channelID, messageID string) string {
+	return channelID + "/" + messageID
+}
+
+// add a message which is about to be deleted
+func (s *deletingSet) add(channelID, messageID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids == nil {
+		s.ids = map[string]struct{}{}
+	}
+	s.ids[deletingKey(channelID, messageID)] = struct{}{}
+}
+
+// remove the message and return whether it was being deleted
+func (s *deletingSet) remove(channelID, messageID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := deletingKey(channelID, messageID)
+	_, ok := s.ids[key]
+	delete(s.ids, key)
+	return ok
+}
+
+func (l *messageLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.store.close()
+}
+
+// memoryMessageStore keeps recent message maps on memory
+type memoryMessageStore struct {
+	records []messageMap
+}
 
+func newMemoryMessageStore(size int) *memoryMessageStore {
+	return &memoryMessageStore{
+		records: make([]messageMap, 0, size),
+	}
+}
+
+func (s *memoryMessageStore) add(channelID, messageID, originID string) error {
 	// Add new message
 	if messageID == originID {
 		// If log count is over record cap, pop first record
-		if cap(l.records) <= len(l.records) {
-			l.records = l.records[1:]
+		if cap(s.records) <= len(s.records) {
+			s.records = s.records[1:]
 		}
-		l.records = append(l.records, newMessageMap(channelID, messageID))
+		s.records = append(s.records, newMessageMap(channelID, messageID))
 	}
 
 	// Add relayed message
-	for _, row := range l.records {
+	for _, row := range s.records {
 		if row.originID == originID {
 			row.mmap[channelID] = messageID
-			return
+			return nil
 		}
 	}
-	logger.Infof("message log: %#v", l.records)
+	logger.Debugf("message log: origin %s of %s in %s is unknown", originID, messageID, channelID)
+	return nil
 }
 
-func (l *messageLog) getMessageMap(channelID, messageID string) map[string]string {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-	for _, record := range l.records {
+func (s *memoryMessageStore) find(channelID, messageID string) (*messageMap, error) {
+	for i, record := range s.records {
 		if msgID, ok := record.mmap[channelID]; ok {
 			if msgID == messageID {
-				return record.mmap
+				return &s.records[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryMessageStore) findByOrigin(originID string) (*messageMap, error) {
+	for i, record := range s.records {
+		if record.originID == originID {
+			return &s.records[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryMessageStore) forget(channelID, messageID string) error {
+	for i, record := range s.records {
+		if msgID, ok := record.mmap[channelID]; ok && msgID == messageID {
+			delete(record.mmap, channelID)
+			if len(record.mmap) == 0 {
+				s.records = append(s.records[:i], s.records[i+1:]...)
 			}
+			return nil
 		}
 	}
 	return nil
 }
+
+func (s *memoryMessageStore) size() int {
+	return len(s.records)
+}
+
+func (s *memoryMessageStore) close() error {
+	return nil
+}
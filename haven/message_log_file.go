@@ -0,0 +1,317 @@
+package haven
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultMessageRetention is retention window of file message store
+	DefaultMessageRetention = time.Hour * 24 * 7
+
+	// compaction runs when obsolete lines exceed live lines and this count
+	compactThreshold = 1000
+)
+
+// messageLogEntry is a line of message log file
+type messageLogEntry struct {
+	ChannelID string `json:"channel"`
+	MessageID string `json:"ts"`
+	OriginID  string `json:"origin"`
+	Time      int64  `json:"time"`
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+// fileMessageStore persists message maps to append-only log file.
+// All maps in retention window are indexed on memory.
+type fileMessageStore struct {
+	path      string
+	retention time.Duration
+	file      *os.File
+	writer    *bufio.Writer
+	records   map[string]*messageMap // key is origin id
+	index     map[string]string      // key is channel id + message id, value is origin id
+	lines     int                    // line count of log file
+	live      int                    // line count of records
+	expiredAt time.Time
+	now       func() time.Time
+}
+
+func messageIndexKey(channelID, messageID string) string {
+	return channelID + "/" + messageID
+}
+
+// openFileMessageStore open message log file, create it if not exists.
+func openFileMessageStore(path string, retention time.Duration) (*fileMessageStore, error) {
+	if retention <= 0 {
+		retention = DefaultMessageRetention
+	}
+	s := &fileMessageStore{
+		path:      path,
+		retention: retention,
+		records:   map[string]*messageMap{},
+		index:     map[string]string{},
+		now:       time.Now,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load read entries from log file
+func (s *fileMessageStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := messageLogEntry{}
+		// a broken line may be left by crash while writing
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			logger.Warnf("message log: skip broken line in %s: %v", s.path, err)
+			continue
+		}
+		s.apply(entry)
+	}
+	s.expire()
+	return scanner.Err()
+}
+
+// apply entry to memory index
+func (s *fileMessageStore) apply(e messageLogEntry) {
+	s.lines++
+	if e.Deleted {
+		m, ok := s.records[e.OriginID]
+		if !ok {
+			return
+		}
+		if ts, ok := m.mmap[e.ChannelID]; ok && ts == e.MessageID {
+			delete(m.mmap, e.ChannelID)
+			delete(s.index, messageIndexKey(e.ChannelID, e.MessageID))
+			s.live--
+		}
+		if len(m.mmap) == 0 {
+			delete(s.records, e.OriginID)
+		}
+		return
+	}
+	if e.MessageID == e.OriginID {
+		if _, ok := s.records[e.OriginID]; ok {
+			return
+		}
+		m := newMessageMap(e.ChannelID, e.MessageID)
+		m.created = e.Time
+		s.records[e.OriginID] = &m
+		s.index[messageIndexKey(e.ChannelID, e.MessageID)] = e.OriginID
+		s.live++
+		return
+	}
+	m, ok := s.records[e.OriginID]
+	if !ok {
+		return
+	}
+	m.mmap[e.ChannelID] = e.MessageID
+	s.index[messageIndexKey(e.ChannelID, e.MessageID)] = e.OriginID
+	s.live++
+}
+
+// expire drop records older than retention window
+func (s *fileMessageStore) expire() {
+	now := s.now()
+	s.expiredAt = now
+	limit := now.Add(-s.retention).Unix()
+	for origin, m := range s.records {
+		if m.created < limit {
+			s.drop(origin)
+		}
+	}
+}
+
+// drop record from memory index
+func (s *fileMessageStore) drop(originID string) {
+	m, ok := s.records[originID]
+	if !ok {
+		return
+	}
+	for ch, ts := range m.mmap {
+		delete(s.index, messageIndexKey(ch, ts))
+	}
+	s.live -= len(m.mmap)
+	delete(s.records, originID)
+}
+
+// compact rewrite log file with live records
+func (s *fileMessageStore) compact() error {
+	if s.file != nil {
+		if err := s.writer.Flush(); err != nil {
+			return err
+		}
+		if err := s.file.Close(); err != nil {
+			return err
+		}
+		s.file = nil
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, m := range s.records {
+		// origin line creates the record on load
+		origin := messageLogEntry{ChannelID: m.originChannelID, MessageID: m.originID, OriginID: m.originID, Time: m.created}
+		entries := []messageLogEntry{origin}
+		for ch, ts := range m.mmap {
+			if ch != m.originChannelID {
+				entries = append(entries, messageLogEntry{ChannelID: ch, MessageID: ts, OriginID: m.originID, Time: m.created})
+			}
+		}
+		// origin is forgotten but copies remain
+		if _, ok := m.mmap[m.originChannelID]; !ok {
+			origin.Deleted = true
+			entries = append(entries, origin)
+		}
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				tmp.Close()
+				return err
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	s.lines = s.live
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.writer = bufio.NewWriter(f)
+	return nil
+}
+
+func (s *fileMessageStore) add(channelID, messageID, originID string) error {
+	if s.file == nil {
+		return fmt.Errorf("message store %s is closed", s.path)
+	}
+	entry := messageLogEntry{
+		ChannelID: channelID,
+		MessageID: messageID,
+		OriginID:  originID,
+		Time:      s.now().Unix(),
+	}
+	if messageID != originID {
+		m, ok := s.records[originID]
+		if !ok {
+			return fmt.Errorf("origin message %s not found", originID)
+		}
+		entry.Time = m.created
+	}
+
+	if err := s.write(entry); err != nil {
+		return err
+	}
+	s.apply(entry)
+
+	// expire and compact at most once per tenth of retention window
+	if s.now().Sub(s.expiredAt) > s.retention/10 {
+		s.expire()
+	}
+	if s.lines-s.live > compactThreshold && s.lines-s.live > s.live {
+		return s.compact()
+	}
+	return nil
+}
+
+// write entry to log file
+func (s *fileMessageStore) write(entry messageLogEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := s.writer.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return s.writer.Flush()
+}
+
+func (s *fileMessageStore) find(channelID, messageID string) (*messageMap, error) {
+	origin, ok := s.index[messageIndexKey(channelID, messageID)]
+	if !ok {
+		return nil, nil
+	}
+	return s.records[origin], nil
+}
+
+func (s *fileMessageStore) findByOrigin(originID string) (*messageMap, error) {
+	return s.records[originID], nil
+}
+
+func (s *fileMessageStore) forget(channelID, messageID string) error {
+	if s.file == nil {
+		return fmt.Errorf("message store %s is closed", s.path)
+	}
+	m, err := s.find(channelID, messageID)
+	if err != nil || m == nil {
+		return err
+	}
+	entry := messageLogEntry{
+		ChannelID: channelID,
+		MessageID: messageID,
+		OriginID:  m.originID,
+		Time:      s.now().Unix(),
+		Deleted:   true,
+	}
+	if err := s.write(entry); err != nil {
+		return err
+	}
+	s.apply(entry)
+	return nil
+}
+
+func (s *fileMessageStore) size() int {
+	return len(s.records)
+}
+
+func (s *fileMessageStore) close() error {
+	if s.file == nil {
+		return nil
+	}
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
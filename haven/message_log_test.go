@@ -0,0 +1,153 @@
+package haven
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/k-saka/lvlogger"
+)
+
+func init() {
+	level, _ := lvlogger.UnmarshalLogLevel("fatal")
+	SetLogger(lvlogger.NewLvLogger(ioutil.Discard, "", log.LstdFlags, level))
+}
+
+func testMessageStore(t *testing.T, store messageStore) {
+	l := newMessageLog(store)
+	l.add("1", "a", "a")
+	l.add("2", "b", "a")
+	l.add("3", "c", "a")
+	l.add("1", "d", "d")
+
+	expected := map[string]string{"1": "a", "2": "b", "3": "c"}
+	if m := l.getMessageMap("2", "b"); !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected message map %v. Actual: %v", expected, m)
+	}
+
+	if m := l.getMessageMap("2", "a"); m != nil {
+		t.Errorf("Expected message map is nil. Actual: %v", m)
+	}
+
+	if !l.isOrigin("1", "a") || l.isOrigin("2", "b") {
+		t.Error("Origin detection failed")
+	}
+
+	// returned map must be a copy
+	l.getMessageMap("1", "a")["9"] = "z"
+	if m := l.getMessageMap("1", "a"); !reflect.DeepEqual(m, expected) {
+		t.Errorf("Message map is modified by caller. Actual: %v", m)
+	}
+}
+
+func testMessageStoreForget(t *testing.T, store messageStore) {
+	l := newMessageLog(store)
+	l.add("1", "a", "a")
+	l.add("2", "b", "a")
+	l.add("3", "c", "a")
+
+	if origin := l.originOf("2", "b"); origin != "a" {
+		t.Errorf("Expected origin a. Actual: %v", origin)
+	}
+
+	l.forget("1", "a")
+	expected := map[string]string{"2": "b", "3": "c"}
+	if m := l.getOriginMap("a"); !reflect.DeepEqual(m, expected) {
+		t.Errorf("Expected message map %v. Actual: %v", expected, m)
+	}
+	if m := l.getMessageMap("1", "a"); m != nil {
+		t.Errorf("Expected forgotten message is not found. Actual: %v", m)
+	}
+
+	l.forget("2", "b")
+	l.forget("3", "c")
+	if m := l.getOriginMap("a"); m != nil {
+		t.Errorf("Expected empty message map is dropped. Actual: %v", m)
+	}
+}
+
+func TestMemoryMessageStore(t *testing.T) {
+	testMessageStore(t, newMemoryMessageStore(10))
+	testMessageStoreForget(t, newMemoryMessageStore(10))
+
+	l := newMessageLog(newMemoryMessageStore(1))
+	l.add("1", "a", "a")
+	l.add("1", "b", "b")
+	if m := l.getMessageMap("1", "a"); m != nil {
+		t.Errorf("Expected old message is popped. Actual: %v", m)
+	}
+}
+
+func TestFileMessageStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "message.log")
+
+	store, err := openFileMessageStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMessageStore(t, store)
+	if err := store.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen, mappings survive
+
+	store, err = openFileMessageStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"1": "a", "2": "b", "3": "c"}
+	if m, _ := store.find("3", "c"); m == nil || !reflect.DeepEqual(m.mmap, expected) {
+		t.Errorf("Expected message map %v after reopen. Actual: %v", expected, m)
+	}
+
+	// expire old mappings
+	store.now = func() time.Time { return time.Now().Add(time.Hour * 2) }
+	store.expire()
+	if m, _ := store.find("3", "c"); m != nil {
+		t.Errorf("Expected message map is expired. Actual: %v", m)
+	}
+	if err := store.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// forgotten messages don't survive
+	path = filepath.Join(dir, "forget.log")
+	store, err = openFileMessageStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMessageStoreForget(t, store)
+	l := newMessageLog(store)
+	l.add("1", "x", "x")
+	l.add("2", "y", "x")
+	l.forget("1", "x")
+	store.close()
+	store, err = openFileMessageStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := store.findByOrigin("a"); m != nil {
+		t.Errorf("Expected forgotten message map after reopen is nil. Actual: %v", m)
+	}
+	if m, _ := store.find("2", "y"); m == nil || !reflect.DeepEqual(m.mmap, map[string]string{"2": "y"}) {
+		t.Errorf("Expected message map without origin after reopen. Actual: %v", m)
+	}
+	// compaction keeps forgotten origin
+	store.compact()
+	store.close()
+	store, _ = openFileMessageStore(path, time.Hour)
+	if m, _ := store.find("1", "x"); m != nil {
+		t.Errorf("Expected forgotten origin after compaction is nil. Actual: %v", m)
+	}
+	store.close()
+}
@@ -0,0 +1,124 @@
+package haven
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "haven"
+
+// metrics is prometheus metrics of a relay bot.
+// Methods are no-op on nil metrics.
+type metrics struct {
+	registry   *prometheus.Registry
+	events     *prometheus.CounterVec
+	relayed    *prometheus.CounterVec
+	apiLatency *prometheus.HistogramVec
+	apiErrors  *prometheus.CounterVec
+	reconnects prometheus.Counter
+}
+
+func newMetrics(messageLog *messageLog) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "events_received_total",
+			Help:      "Slack events received by type.",
+		}, []string{"type"}),
+		relayed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "relayed_total",
+			Help:      "Messages, edits, deletions, reactions and files relayed by destination channel.",
+		}, []string{"kind", "channel"}),
+		apiLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_request_duration_seconds",
+			Help:      "Slack web api call latency including retries by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_errors_total",
+			Help:      "Failed slack web api calls by method.",
+		}, []string{"method"}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reconnects_total",
+			Help:      "Reconnections after connection lost.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.events,
+		m.relayed,
+		m.apiLatency,
+		m.apiErrors,
+		m.reconnects,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "message_log_size",
+			Help:      "Relayed messages kept in message log.",
+		}, func() float64 { return float64(messageLog.size()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "message_log_lookups_total",
+			Help:        "Message log lookups by result.",
+			ConstLabels: prometheus.Labels{"result": "hit"},
+		}, func() float64 {
+			hits, _ := messageLog.lookups()
+			return float64(hits)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "message_log_lookups_total",
+			Help:        "Message log lookups by result.",
+			ConstLabels: prometheus.Labels{"result": "miss"},
+		}, func() float64 {
+			_, misses := messageLog.lookups()
+			return float64(misses)
+		}),
+		collectors.NewGoCollector(),
+	)
+	return m
+}
+
+func (m *metrics) eventReceived(eventType string) {
+	if m == nil {
+		return
+	}
+	m.events.WithLabelValues(eventType).Inc()
+}
+
+func (m *metrics) delivered(kind, channelID string) {
+	if m == nil {
+		return
+	}
+	m.relayed.WithLabelValues(kind, channelID).Inc()
+}
+
+func (m *metrics) reconnected() {
+	if m == nil {
+		return
+	}
+	m.reconnects.Inc()
+}
+
+// observeAPI record a slack api call
+func (m *metrics) observeAPI(method string, elapsed time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.apiLatency.WithLabelValues(method).Observe(elapsed.Seconds())
+	if err != nil {
+		m.apiErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// handler serve metrics in prometheus text format
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,46 @@
+package haven
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	l := newMessageLog(newMemoryMessageStore(DefaultMessageLogSize))
+	l.add("1", "a", "a")
+	l.originOf("1", "a")
+	l.originOf("1", "b")
+
+	m := newMetrics(l)
+	m.eventReceived("message")
+	m.delivered(outboxPost, "2")
+	m.observeAPI("chat.postMessage", time.Millisecond, nil)
+	m.observeAPI("chat.postMessage", time.Millisecond, errors.New("failed"))
+	m.reconnected()
+
+	// nil metrics is no-op
+	var nilMetrics *metrics
+	nilMetrics.eventReceived("message")
+
+	w := httptest.NewRecorder()
+	m.handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, expected := range []string{
+		`haven_events_received_total{type="message"} 1`,
+		`haven_relayed_total{channel="2",kind="post"} 1`,
+		`haven_api_request_duration_seconds_count{method="chat.postMessage"} 2`,
+		`haven_api_errors_total{method="chat.postMessage"} 1`,
+		`haven_reconnects_total 1`,
+		`haven_message_log_size 1`,
+		`haven_message_log_lookups_total{result="hit"} 1`,
+		`haven_message_log_lookups_total{result="miss"} 1`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected %s in metrics", expected)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package haven
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Outbox entry kinds
+const (
+	outboxPost           = "post"
+	outboxUpdate         = "update"
+	outboxDelete         = "delete"
+	outboxReactionAdd    = "reaction_add"
+	outboxReactionRemove = "reaction_remove"
+	outboxUpload         = "upload"
+)
+
+// outboxEntry is a relaying api call to a destination channel.
+// It's serializable, so it can be replayed after restart.
+type outboxEntry struct {
+	ID       uint64 `json:"id"`
+	Kind     string `json:"kind,omitempty"`
+	Channel  string `json:"channel,omitempty"`
+	OriginID string `json:"origin,omitempty"`
+	Time     int64  `json:"time,omitempty"` // unix time of enqueued
+	// ThreadOrigin is origin id of thread parent
+	ThreadOrigin string                `json:"thread_origin,omitempty"`
+	Post         *postMessageRequest   `json:"post,omitempty"`
+	Update       *messageUpdateRequest `json:"update,omitempty"`
+	Reaction     string                `json:"reaction,omitempty"`
+	File         *slackFile            `json:"file,omitempty"`
+
+	// state lines have only id and these flags
+	Started bool `json:"started,omitempty"`
+	Done    bool `json:"done,omitempty"`
+
+	// content is downloaded file, downloaded by delivery task and again on replay
+	content []byte
+}
+
+// outboxCompactThreshold is line count which triggers compaction
+const outboxCompactThreshold = 1000
+
+// outbox is write ahead queue of relaying api calls.
+// Entries are appended before delivered and marked done after delivered.
+// Without path, it only numbers entries.
+type outbox struct {
+	path    string
+	mu      sync.Mutex
+	file    *os.File
+	nextID  uint64
+	pending map[uint64]*outboxEntry
+	lines   int
+}
+
+// openOutbox open outbox file and return entries not done yet in appended order
+func openOutbox(path string) (*outbox, []*outboxEntry, error) {
+	o := &outbox{
+		path:    path,
+		nextID:  1,
+		pending: map[uint64]*outboxEntry{},
+	}
+	if path == "" {
+		return o, nil, nil
+	}
+	if err := o.load(); err != nil {
+		return nil, nil, err
+	}
+	if err := o.compact(); err != nil {
+		return nil, nil, err
+	}
+	return o, o.pendingEntries(), nil
+}
+
+func (o *outbox) load() error {
+	f, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		e := &outboxEntry{}
+		// a broken line may be left by crash while writing
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			logger.Warnf("outbox: skip broken line in %s: %v", o.path, err)
+			continue
+		}
+		o.lines++
+		if e.ID >= o.nextID {
+			o.nextID = e.ID + 1
+		}
+		switch {
+		case e.Done:
+			delete(o.pending, e.ID)
+		case e.Kind == "":
+			// started line
+			if p, ok := o.pending[e.ID]; ok {
+				p.Started = true
+			}
+		default:
+			o.pending[e.ID] = e
+		}
+	}
+	return scanner.Err()
+}
+
+func (o *outbox) pendingEntries() []*outboxEntry {
+	entries := make([]*outboxEntry, 0, len(o.pending))
+	for _, e := range o.pending {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// compact rewrite outbox file with pending entries
+func (o *outbox) compact() error {
+	if o.file != nil {
+		if err := o.file.Close(); err != nil {
+			return err
+		}
+		o.file = nil
+	}
+	tmpPath := o.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, e := range o.pendingEntries() {
+		if err := enc.Encode(e); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		return err
+	}
+	o.lines = len(o.pending)
+
+	f, err := os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	o.file = f
+	return nil
+}
+
+// write a line and sync it
+func (o *outbox) write(e *outboxEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := o.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	o.lines++
+	return o.file.Sync()
+}
+
+// append an entry, it's numbered here
+func (o *outbox) append(e *outboxEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e.ID = o.nextID
+	o.nextID++
+	if o.file == nil {
+		return nil
+	}
+	o.pending[e.ID] = e
+	return o.write(e)
+}
+
+// start mark the entry is about to be called
+func (o *outbox) start(e *outboxEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e.Started = true
+	if o.file == nil {
+		return nil
+	}
+	return o.write(&outboxEntry{ID: e.ID, Started: true})
+}
+
+// done mark the entry is delivered or given up
+func (o *outbox) done(e *outboxEntry) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.file == nil {
+		return nil
+	}
+	delete(o.pending, e.ID)
+	if err := o.write(&outboxEntry{ID: e.ID, Done: true}); err != nil {
+		return err
+	}
+	if o.lines > outboxCompactThreshold && o.lines > len(o.pending)*2 {
+		return o.compact()
+	}
+	return nil
+}
+
+func (o *outbox) close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.file == nil {
+		return nil
+	}
+	err := o.file.Close()
+	o.file = nil
+	return err
+}
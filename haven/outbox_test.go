@@ -0,0 +1,96 @@
+package haven
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "outbox")
+
+	o, pending, err := openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected no pending entries. Actual: %v", pending)
+	}
+
+	post := &outboxEntry{Kind: outboxPost, Channel: "1", OriginID: "a", Post: &postMessageRequest{Text: "hello"}}
+	update := &outboxEntry{Kind: outboxUpdate, Channel: "1", OriginID: "a", Update: &messageUpdateRequest{Text: "hi"}}
+	reaction := &outboxEntry{Kind: outboxReactionAdd, Channel: "2", OriginID: "a", Reaction: "+1"}
+	for _, e := range []*outboxEntry{post, update, reaction} {
+		if err := o.append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.start(post)
+	o.done(update)
+	o.close()
+
+	// crash leaves broken line
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":4,"kind":"po`)
+	f.Close()
+
+	o, pending, err = openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].ID != post.ID || pending[1].ID != reaction.ID {
+		t.Fatalf("Expected post and reaction are pending. Actual: %+v", pending)
+	}
+	if !pending[0].Started || pending[0].Post.Text != "hello" || pending[1].Started {
+		t.Errorf("Unexpected pending entries %+v %+v", *pending[0], *pending[1])
+	}
+
+	// ids are not reused
+	e := &outboxEntry{Kind: outboxDelete, Channel: "2", OriginID: "a"}
+	o.append(e)
+	if e.ID <= reaction.ID {
+		t.Errorf("Expected new id after %v. Actual: %v", reaction.ID, e.ID)
+	}
+
+	// compaction keeps pending entries
+	for i := 0; i < outboxCompactThreshold; i++ {
+		e := &outboxEntry{Kind: outboxPost, Channel: "3", OriginID: "b"}
+		o.append(e)
+		o.done(e)
+	}
+	if o.lines > outboxCompactThreshold {
+		t.Errorf("Expected outbox is compacted. Actual lines %v", o.lines)
+	}
+	o.close()
+
+	_, pending, err = openOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 3 || !pending[0].Started {
+		t.Errorf("Expected 3 pending entries and started state is kept. Actual: %+v", pending)
+	}
+}
+
+func TestOutboxWithoutPath(t *testing.T) {
+	o, pending, err := openOutbox("")
+	if err != nil || pending != nil {
+		t.Fatalf("Unexpected result %v %v", pending, err)
+	}
+	e := &outboxEntry{Kind: outboxPost, Channel: "1"}
+	if err := o.append(e); err != nil || e.ID != 1 {
+		t.Errorf("Expected entry is numbered. Actual: %v %v", e.ID, err)
+	}
+	if err := o.done(e); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,169 @@
+package haven
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// errNoStatePath is returned on change without state file, the change would be lost by restart
+var errNoStatePath = errors.New("changes can't be kept over restart without state file, set state option")
+
+// relayState keeps relay channels and pause changed by admin commands.
+// Changes are kept apart from config, so they are applied on top of reloaded config.
+// It's saved to file on change. Without path, it's read only and changes are refused.
+type relayState struct {
+	path string
+	data relayStateData
+}
+
+type relayStateData struct {
+	// Added maps group name to added relay room definitions "ID[:direction]"
+	Added map[string][]string `json:"added,omitempty"`
+	// Removed maps group name to removed channel ids
+	Removed map[string][]string `json:"removed,omitempty"`
+	Paused  bool                `json:"paused,omitempty"`
+}
+
+func openRelayState(path string) (*relayState, error) {
+	s := &relayState{path: path}
+	if path == "" {
+		return s, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &s.data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// withoutRoom return room definitions except the channel
+func withoutRoom(specs []string, channelID string) []string {
+	rest := []string{}
+	for _, spec := range specs {
+		if id, _, _ := ParseRelayRoom(spec); id != channelID {
+			rest = append(rest, spec)
+		}
+	}
+	return rest
+}
+
+// setRooms set room definitions of the group, empty one is deleted
+func setRooms(groups map[string][]string, name string, specs []string) map[string][]string {
+	if groups == nil {
+		groups = map[string][]string{}
+	}
+	if len(specs) == 0 {
+		delete(groups, name)
+	} else {
+		groups[name] = specs
+	}
+	return groups
+}
+
+// add the channel to the group
+func (s *relayState) add(name, channelID string, dir RelayDirection) error {
+	if s.path == "" {
+		return errNoStatePath
+	}
+	spec := channelID
+	if dir != Bidirectional {
+		spec += ":" + dir.String()
+	}
+	s.data.Removed = setRooms(s.data.Removed, name, withoutRoom(s.data.Removed[name], channelID))
+	s.data.Added = setRooms(s.data.Added, name, append(withoutRoom(s.data.Added[name], channelID), spec))
+	return s.save()
+}
+
+// remove the channel from the group
+func (s *relayState) remove(name, channelID string) error {
+	if s.path == "" {
+		return errNoStatePath
+	}
+	s.data.Added = setRooms(s.data.Added, name, withoutRoom(s.data.Added[name], channelID))
+	s.data.Removed = setRooms(s.data.Removed, name, append(withoutRoom(s.data.Removed[name], channelID), channelID))
+	return s.save()
+}
+
+// paused tests relaying is paused. It's false on nil state.
+func (s *relayState) paused() bool {
+	return s != nil && s.data.Paused
+}
+
+func (s *relayState) setPaused(paused bool) error {
+	if s.path == "" {
+		return errNoStatePath
+	}
+	s.data.Paused = paused
+	return s.save()
+}
+
+// apply return relay groups with changes applied. groups isn't modified.
+func (s *relayState) apply(groups map[string]map[string]RelayDirection) map[string]map[string]RelayDirection {
+	applied := make(map[string]map[string]RelayDirection, len(groups))
+	for name, rooms := range groups {
+		copied := make(map[string]RelayDirection, len(rooms))
+		for id, dir := range rooms {
+			copied[id] = dir
+		}
+		applied[name] = copied
+	}
+	for name, ids := range s.data.Removed {
+		for _, id := range ids {
+			delete(applied[name], id)
+		}
+	}
+	for name, specs := range s.data.Added {
+		rooms, err := ParseRelayRooms(specs)
+		if err != nil {
+			logger.Warnf("invalid relay state of group %s: %v", name, err)
+			continue
+		}
+		if _, ok := applied[name]; !ok {
+			applied[name] = map[string]RelayDirection{}
+		}
+		for id, dir := range rooms {
+			applied[name][id] = dir
+		}
+	}
+	for name, rooms := range applied {
+		if len(rooms) == 0 {
+			delete(applied, name)
+		}
+	}
+	return applied
+}
+
+// save write state to file. It's replaced atomically.
+func (s *relayState) save() error {
+	buf, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// parseChannelMention return channel id of slack channel mention "<#ID|name>".
+// Other text is returned as is.
+func parseChannelMention(text string) string {
+	if !strings.HasPrefix(text, "<#") || !strings.HasSuffix(text, ">") {
+		return text
+	}
+	id := text[2 : len(text)-1]
+	if i := strings.Index(id, "|"); i >= 0 {
+		id = id[:i]
+	}
+	return id
+}
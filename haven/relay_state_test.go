@@ -0,0 +1,104 @@
+package haven
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// openTestRelayState open relay state in a temporary directory. Call cleanup after test.
+func openTestRelayState(t *testing.T) (s *relayState, cleanup func()) {
+	dir, err := ioutil.TempDir("", "haven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = openRelayState(filepath.Join(dir, "state"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestRelayState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	configured := map[string]map[string]RelayDirection{
+		"a": {"C1": Bidirectional, "C2": Bidirectional},
+	}
+	s, err := openRelayState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.add("a", "C3", SendOnly)
+	s.add("b", "C4", Bidirectional)
+	s.remove("a", "C2")
+	s.remove("b", "C9")
+	s.setPaused(true)
+
+	s, err = openRelayState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]RelayDirection{
+		"a": {"C1": Bidirectional, "C3": SendOnly},
+		"b": {"C4": Bidirectional},
+	}
+	if applied := s.apply(configured); !reflect.DeepEqual(applied, expected) {
+		t.Errorf("Expected %v. Actual: %v", expected, applied)
+	}
+	if len(configured["a"]) != 2 {
+		t.Errorf("Expected configured groups are not modified. Actual: %v", configured)
+	}
+	if !s.paused() {
+		t.Error("Expected paused after reopen")
+	}
+
+	// adding removed channel again cancels removal
+	s.add("a", "C2", ReceiveOnly)
+	s.remove("a", "C3")
+	s.remove("b", "C4")
+	expected = map[string]map[string]RelayDirection{
+		"a": {"C1": Bidirectional, "C2": ReceiveOnly},
+	}
+	if applied := s.apply(configured); !reflect.DeepEqual(applied, expected) {
+		t.Errorf("Expected %v. Actual: %v", expected, applied)
+	}
+}
+
+func TestRelayStateWithoutPath(t *testing.T) {
+	s, err := openRelayState("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.add("a", "C3", Bidirectional); err != errNoStatePath {
+		t.Errorf("Expected change is refused. Actual: %v", err)
+	}
+	if err := s.setPaused(true); err != errNoStatePath || s.paused() {
+		t.Errorf("Expected pause is refused. Actual: %v", err)
+	}
+	configured := map[string]map[string]RelayDirection{"a": {"C1": Bidirectional, "C2": Bidirectional}}
+	if applied := s.apply(configured); !reflect.DeepEqual(applied, configured) {
+		t.Errorf("Expected configured groups. Actual: %v", applied)
+	}
+}
+
+func TestParseChannelMention(t *testing.T) {
+	cases := map[string]string{
+		"<#C123|general>": "C123",
+		"<#C123>":         "C123",
+		"C123":            "C123",
+	}
+	for input, expected := range cases {
+		if actual := parseChannelMention(input); actual != expected {
+			t.Errorf("Expected %v. Actual: %v", expected, actual)
+		}
+	}
+}
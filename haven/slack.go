@@ -2,9 +2,13 @@ package haven
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -13,8 +17,12 @@ import (
 )
 
 const (
-	// ReconnectInterval is try to connect slack rtm api interval
-	ReconnectInterval = time.Second * 10
+	// MaxCatchUpAge is how old messages are caught up after disconnection
+	MaxCatchUpAge = time.Hour * 24
+	// DelayedSuffix is appended to sender name of caught up messages
+	DelayedSuffix = " (delayed)"
+	// DefaultShutdownTimeout is how long pending deliveries are waited on shutdown
+	DefaultShutdownTimeout = time.Second * 30
 )
 
 var logger *lvlogger.LvLogger
@@ -24,8 +32,14 @@ func SetLogger(log *lvlogger.LvLogger) {
 	logger = log
 }
 
+// relayChannel is a channel with relaying direction
+type relayChannel struct {
+	channel
+	direction RelayDirection
+}
+
 // relayGroup represents relaying channel group
-type relayGroup map[string]channel
+type relayGroup map[string]relayChannel
 
 // hasChannel tests a channel exists in RelayGroup
 func (g relayGroup) hasChannel(cID string) bool {
@@ -59,16 +73,18 @@ func (g relayGroup) channelCount() int {
 	return len(g)
 }
 
-// determineRelayChannels determine relay channels
+// determineRelayChannels determine relay channels.
+// Channel directions are honored.
 func (g relayGroup) determineRelayChannels(cid string) []string {
 	toRelay := []string{}
 
-	if !g.hasChannel(cid) {
+	from, ok := g[cid]
+	if !ok || !from.direction.canSend() {
 		return nil
 	}
 
 	for _, channel := range g {
-		if channel.ID != cid {
+		if channel.ID != cid && channel.direction.canReceive() {
 			toRelay = append(toRelay, channel.ID)
 		}
 	}
@@ -112,121 +128,527 @@ func (g relayGroup) determineRelayChannelsMulti(cids []string) []string {
 	return nil
 }
 
-// newRelayGroup create RelayGroup from config
-func newRelayGroup(config *Config, channels []channel) relayGroup {
+// newRelayGroup create RelayGroup from relay room ids and directions
+func newRelayGroup(rooms map[string]RelayDirection, channels []channel) relayGroup {
 	group := relayGroup{}
-	for _, channel := range channels {
-		if _, ok := config.RelayRooms[channel.ID]; ok {
-			group[channel.ID] = channel
+	for _, ch := range channels {
+		if dir, ok := rooms[ch.ID]; ok {
+			group[ch.ID] = relayChannel{channel: ch, direction: dir}
 		}
 	}
 	return group
 }
 
+// relayGroups represents named relay groups.
+// A channel relays only to channels in same group.
+type relayGroups map[string]relayGroup
+
+// names return sorted group names
+func (gs relayGroups) names() []string {
+	names := make([]string, 0, len(gs))
+	for name := range gs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// groupsOf return groups which contain the channel
+func (gs relayGroups) groupsOf(cID string) relayGroups {
+	found := relayGroups{}
+	for name, g := range gs {
+		if g.hasChannel(cID) {
+			found[name] = g
+		}
+	}
+	return found
+}
+
+// hasChannel tests a channel exists in any group
+func (gs relayGroups) hasChannel(cID string) bool {
+	for _, g := range gs {
+		if g.hasChannel(cID) {
+			return true
+		}
+	}
+	return false
+}
+
+// channelIDs return sorted channel ids over all groups
+func (gs relayGroups) channelIDs() []string {
+	ids := map[string]struct{}{}
+	for _, g := range gs {
+		for cID := range g {
+			ids[cID] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(ids))
+	for cID := range ids {
+		sorted = append(sorted, cID)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// hasUser tests a user exists in any group
+func (gs relayGroups) hasUser(uID string) bool {
+	for _, g := range gs {
+		if g.hasUser(uID) {
+			return true
+		}
+	}
+	return false
+}
+
+// determineRelayChannels determine relay channels over all groups containing cid
+func (gs relayGroups) determineRelayChannels(cid string) []string {
+	return gs.determineRelayChannelsMulti([]string{cid})
+}
+
+// determineRelayChannelsMulti determine relay channels by channel ids over all groups
+func (gs relayGroups) determineRelayChannelsMulti(cids []string) []string {
+	toRelay := map[string]struct{}{}
+	for _, g := range gs {
+		for _, toCid := range g.determineRelayChannelsMulti(cids) {
+			toRelay[toCid] = struct{}{}
+		}
+	}
+
+	if len(toRelay) < 1 {
+		return nil
+	}
+
+	toRelayCids := make([]string, 0, len(toRelay))
+	for cid := range toRelay {
+		toRelayCids = append(toRelayCids, cid)
+	}
+	sort.Strings(toRelayCids)
+	return toRelayCids
+}
+
+// addMember add a user to the channel in all groups
+func (gs relayGroups) addMember(cID, uID string) {
+	for _, g := range gs {
+		ch, ok := g[cID]
+		if !ok {
+			continue
+		}
+		i := sort.SearchStrings(ch.Members, uID)
+		if i < len(ch.Members) && ch.Members[i] == uID {
+			continue
+		}
+		members := make([]string, 0, len(ch.Members)+1)
+		members = append(members, ch.Members[:i]...)
+		members = append(members, uID)
+		ch.Members = append(members, ch.Members[i:]...)
+		g[cID] = ch
+	}
+}
+
+// removeMember remove a user from the channel in all groups
+func (gs relayGroups) removeMember(cID, uID string) {
+	for _, g := range gs {
+		ch, ok := g[cID]
+		if !ok {
+			continue
+		}
+		members := make([]string, 0, len(ch.Members))
+		for _, m := range ch.Members {
+			if m != uID {
+				members = append(members, m)
+			}
+		}
+		ch.Members = members
+		g[cID] = ch
+	}
+}
+
+// addChannel add a channel to groups which config contains it
+func (gs relayGroups) addChannel(config *Config, ch channel) {
+	for name, rooms := range config.RelayGroups {
+		dir, ok := rooms[ch.ID]
+		if !ok {
+			continue
+		}
+		if _, ok := gs[name]; !ok {
+			gs[name] = relayGroup{}
+		}
+		gs[name][ch.ID] = relayChannel{channel: ch, direction: dir}
+	}
+}
+
+// removeChannel remove a channel from all groups
+func (gs relayGroups) removeChannel(cID string) {
+	for _, g := range gs {
+		delete(g, cID)
+	}
+}
+
+// newRelayGroups create RelayGroups from config
+func newRelayGroups(config *Config, channels []channel) relayGroups {
+	groups := make(relayGroups, len(config.RelayGroups))
+	for name, rooms := range config.RelayGroups {
+		groups[name] = newRelayGroup(rooms, channels)
+	}
+	return groups
+}
+
 // RelayBot relay multiple channels
 // Supported events are chat, file and shared message.
 type RelayBot struct {
-	url        string
-	ws         *WsClient
-	config     *Config
-	messageLog *messageLog
-	relayGroup relayGroup
-	users      map[string]user
-	hubUser    self
+	transport   transport
+	config      *Config
+	messageLog  *messageLog
+	relayGroups relayGroups
+	users       *userCache
+	api         *apiClient
+	delivery    *deliverer
+	outbox      *outbox
+	lastSeen    *lastSeen
+	conn        *connectionTracker
+	metrics     *metrics
+	admin       *adminServer // nil if AdminAddr isn't configured
+	// deleting is relayed copies being deleted by this bot
+	deleting deletingSet
+	// state is relay channels and pause changed by admin commands
+	state *relayState
+	// configGroups is relay groups given by config, before admin commands are applied
+	configGroups map[string]map[string]RelayDirection
+	// replay is undelivered entries of last run
+	replay []*outboxEntry
+	// reloads passes reloaded config to event loop
+	reloads chan *Config
+	// missed passes history fetched by catch-up to event loop
+	missed  chan *missedMessages
+	hubUser self
 }
 
 // NewRelayBot create RelayBot
-func NewRelayBot(config *Config) *RelayBot {
-	return &RelayBot{
-		config:     config,
-		ws:         NewWsClient(),
-		messageLog: newMessageLog(100),
+func NewRelayBot(config *Config) (*RelayBot, error) {
+	api := newAPIClient(config.Token)
+	transport, err := newTransport(config, api)
+	if err != nil {
+		return nil, err
+	}
+	messageLog, err := newMessageLogFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	outbox, replay, err := openOutbox(config.OutboxPath)
+	if err != nil {
+		return nil, err
+	}
+	lastSeen, err := openLastSeen(config.LastSeenPath)
+	if err != nil {
+		return nil, err
 	}
+	state, err := openRelayState(config.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	applied := *config
+	applied.RelayGroups = state.apply(config.RelayGroups)
+	metrics := newMetrics(messageLog)
+	api.observe = metrics.observeAPI
+	return &RelayBot{
+		config:       &applied,
+		transport:    transport,
+		messageLog:   messageLog,
+		users:        newUserCache(api.fetchUserInfo),
+		api:          api,
+		delivery:     newDeliverer(DeliveryQueueSize),
+		outbox:       outbox,
+		replay:       replay,
+		lastSeen:     lastSeen,
+		conn:         newConnectionTracker(),
+		metrics:      metrics,
+		state:        state,
+		configGroups: config.RelayGroups,
+		reloads:      make(chan *Config, 1),
+		missed:       make(chan *missedMessages),
+	}, nil
 }
 
-func (b *RelayBot) postMembersInfo(cID string) {
+// membersInfo return members of relay groups of the channel
+func (b *RelayBot) membersInfo(cID string) string {
+	groups := b.relayGroups.groupsOf(cID)
 	buf := bytes.Buffer{}
 	tw := tabwriter.NewWriter(&buf, 0, 8, 0, '\t', 0)
 	buf.WriteString("```")
-	buf.WriteString("Haven members\n")
-	for _, ch := range b.relayGroup {
-		for _, uid := range ch.Members {
-			user, ok := b.users[uid]
-			if !ok {
-				continue
+	for _, name := range groups.names() {
+		fmt.Fprintf(tw, "Haven members (%s)\n", name)
+		for _, ch := range groups[name] {
+			for _, uid := range ch.Members {
+				user, err := b.users.get(uid)
+				if err != nil {
+					logger.Warnf("cant fetch user %s: %v", uid, err)
+					continue
+				}
+				fmt.Fprintf(tw, "Account:%s\tName:%s\n", user.Name, user.Profile.FullName())
 			}
-			fmt.Fprintf(tw, "Account:%s\tName:%s\n", user.Name, user.Profile.FullName())
 		}
 	}
 	tw.Flush()
 	buf.WriteString("```")
-
-	pm := postMessageRequest{
-		Channel:   cID,
-		Text:      buf.String(),
-		LinkNames: 0,
-		UserName:  "Slack haven",
-	}
-	_, err := postMessage(b.config.Token, pm)
-	if err != nil {
-		logger.Warnf("%v", err)
-	}
+	return buf.String()
 }
 
-func (b *RelayBot) postBotStatus(cID string) {
+// botStatus return connection and delivery status of relay groups of the channel
+func (b *RelayBot) botStatus(cID string) string {
+	groups := b.relayGroups.groupsOf(cID)
 	mem := runtime.MemStats{}
 	runtime.ReadMemStats(&mem)
 	buf := bytes.Buffer{}
 	tw := tabwriter.NewWriter(&buf, 0, 8, 0, '\t', 0)
 	buf.WriteString("```\n")
 	fmt.Fprintf(tw, "Haven status\n")
+	conn := b.conn.get()
+	fmt.Fprintf(tw, "Connection\t%v since %v\n", conn.State, conn.Since.Format(time.RFC3339))
+	for _, name := range groups.names() {
+		fmt.Fprintf(tw, "Group %s\t%v channels\n", name, groups[name].channelCount())
+	}
+	for _, stats := range b.delivery.stats() {
+		if !groups.hasChannel(stats.Channel) {
+			continue
+		}
+		fmt.Fprintf(tw, "Queue %s\tdepth %v, delivered %v, failed %v, retried %v, blocked %v, latency %v\n",
+			stats.Channel, stats.Depth, stats.Delivered, stats.Failed, stats.Retried, stats.Blocked, stats.Latency)
+	}
 	fmt.Fprintf(tw, "Goroutine count\t%v\n", runtime.NumGoroutine())
 	fmt.Fprintf(tw, "Total allock\t%v\n", mem.TotalAlloc)
 	tw.Flush()
 	buf.WriteString("```\n")
-	pm := postMessageRequest{
-		Channel:   cID,
-		Text:      buf.String(),
-		LinkNames: 0,
-		UserName:  "Slack haven",
+	return buf.String()
+}
+
+// deliver write an entry to outbox and enqueue it to destination channel
+func (b *RelayBot) deliver(e *outboxEntry) {
+	e.Time = time.Now().Unix()
+	if err := b.outbox.append(e); err != nil {
+		logger.Warnf("cant write outbox: %v", err)
+	}
+	b.enqueue(e)
+}
+
+// enqueue an outbox entry. It's marked done unless failed temporarily.
+func (b *RelayBot) enqueue(e *outboxEntry) {
+	b.delivery.enqueue(e.Channel, e.Kind, func() error {
+		err := b.execute(e)
+		if err != nil && isTemporary(err) {
+			return err
+		}
+		if err == nil {
+			b.metrics.delivered(e.Kind, e.Channel)
+		}
+		if err := b.outbox.done(e); err != nil {
+			logger.Warnf("cant write outbox: %v", err)
+		}
+		return err
+	})
+}
+
+// replayOutbox enqueue entries left undelivered by last run
+func (b *RelayBot) replayOutbox() {
+	if len(b.replay) > 0 {
+		logger.Infof("replay %d undelivered entries", len(b.replay))
+	}
+	for _, e := range b.replay {
+		b.enqueue(e)
+	}
+	b.replay = nil
+}
+
+// execute an outbox entry. It runs in delivery queue of the destination channel.
+// Copies are resolved by origin id here, because posting them may finish just before in same queue.
+func (b *RelayBot) execute(e *outboxEntry) error {
+	switch e.Kind {
+	case outboxPost:
+		return b.relayMessage(e)
+	case outboxUpdate:
+		ts := b.messageLog.getOriginMap(e.OriginID)[e.Channel]
+		if ts == "" {
+			return nil
+		}
+		req := *e.Update
+		req.Channel = e.Channel
+		req.Ts = ts
+		return b.api.updateMessage(req)
+	case outboxDelete:
+		ts := b.messageLog.getOriginMap(e.OriginID)[e.Channel]
+		if ts == "" {
+			return nil
+		}
+		// deletion event caused by this bot is ignored
+		b.deleting.add(e.Channel, ts)
+		err := b.api.deleteMessage(messageDeleteRequest{Channel: e.Channel, Ts: ts})
+		if isAPIError(err, "message_not_found") {
+			err = nil
+		}
+		if err == nil {
+			// forgotten only after deleted, so a retry finds the message again
+			b.messageLog.forget(e.Channel, ts)
+		} else if !isTemporary(err) {
+			b.deleting.remove(e.Channel, ts)
+		}
+		return err
+	case outboxReactionAdd:
+		ts := b.messageLog.getOriginMap(e.OriginID)[e.Channel]
+		if ts == "" {
+			return nil
+		}
+		err := b.api.addReaction(reactionAddRequest{Name: e.Reaction, Channel: e.Channel, Timestamp: ts})
+		if isAPIError(err, "already_reacted") {
+			return nil
+		}
+		return err
+	case outboxReactionRemove:
+		ts := b.messageLog.getOriginMap(e.OriginID)[e.Channel]
+		if ts == "" {
+			return nil
+		}
+		err := b.api.removeReaction(reactionRemoveRequest{Name: e.Reaction, Channel: e.Channel, Timestamp: ts})
+		if isAPIError(err, "no_reaction") {
+			return nil
+		}
+		return err
+	case outboxUpload:
+		return b.relayFile(e)
+	}
+	logger.Warnf("unknown outbox entry %+v", *e)
+	return nil
+}
+
+// relayMessage post a message and log it.
+// Thread parent is resolved by ThreadOrigin.
+func (b *RelayBot) relayMessage(e *outboxEntry) error {
+	if e.Started {
+		// last post may be succeeded without response, find it before posting again
+		ts, err := b.findRelayed(e)
+		if err != nil {
+			return err
+		}
+		if ts != "" {
+			logger.Infof("message %s is relayed to %s already", e.OriginID, e.Channel)
+			b.messageLog.add(e.Channel, ts, e.OriginID)
+			return nil
+		}
+	}
+
+	pm := *e.Post
+	pm.Channel = e.Channel
+	pm.Metadata = &messageMetadata{
+		EventType:    relayEventType,
+		EventPayload: relayMetadata{Origin: e.OriginID},
+	}
+	if e.ThreadOrigin != "" {
+		pm.ThreadTs = b.messageLog.getOriginMap(e.ThreadOrigin)[pm.Channel]
+		if pm.ThreadTs == "" {
+			logger.Debugf("thread parent is unknown in %s. relay as top level", pm.Channel)
+			pm.ReplyBroadcast = false
+		}
+	}
+	if err := b.outbox.start(e); err != nil {
+		logger.Warnf("cant write outbox: %v", err)
 	}
-	_, err := postMessage(b.config.Token, pm)
+	resp, err := b.api.postMessage(pm)
 	if err != nil {
-		logger.Warnf("%v", err)
+		return err
 	}
+	// message log
+	b.messageLog.add(pm.Channel, resp.Ts, e.OriginID)
+	logger.Debugf("relayed message %v", pm)
+	return nil
 }
 
-func (b *RelayBot) handleSystemMessage(msg *message) {
-	text := strings.ToLower(msg.Text)
-	if strings.Contains(text, "members") {
-		b.postMembersInfo(msg.Channel)
-		return
+// findRelayed find a copy of the entry posted by this bot in channel history,
+// or in replies of the thread if it's a thread reply
+func (b *RelayBot) findRelayed(e *outboxEntry) (string, error) {
+	oldest := strconv.FormatInt(e.Time-1, 10)
+	threadTs := ""
+	if e.ThreadOrigin != "" {
+		threadTs = b.messageLog.getOriginMap(e.ThreadOrigin)[e.Channel]
 	}
-	if strings.Contains(text, "status") {
-		b.postBotStatus(msg.Channel)
-		return
+	var messages []message
+	var err error
+	if threadTs != "" {
+		messages, err = b.api.fetchReplies(e.Channel, threadTs, oldest)
+	} else {
+		messages, err = b.api.fetchHistory(e.Channel, oldest)
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, msg := range messages {
+		if msg.Metadata != nil && msg.Metadata.EventType == relayEventType &&
+			msg.Metadata.EventPayload.Origin == e.OriginID {
+			return msg.Ts, nil
+		}
+	}
+	return "", nil
+}
+
+// relayFile upload a file. An upload started before is looked up in history first,
+// so it's never uploaded twice.
+func (b *RelayBot) relayFile(e *outboxEntry) error {
+	if e.Started {
+		// last upload may be succeeded without response
+		found, err := b.findUploaded(e)
+		if err != nil {
+			return err
+		}
+		if found {
+			logger.Infof("file %s is uploaded to %s already", e.File.Name, e.Channel)
+			return nil
+		}
+	}
+	if e.content == nil {
+		content, err := b.api.downloadFile(e.File.URLPrivate)
+		if err != nil {
+			return err
+		}
+		e.content = content
 	}
+	if err := b.outbox.start(e); err != nil {
+		logger.Warnf("cant write outbox: %v", err)
+	}
+	return b.api.uploadFile([]string{e.Channel}, e.content, e.File)
 }
 
-func (b *RelayBot) relayMessage(originID string, pm postMessageRequest) {
-	resp, err := postMessage(b.config.Token, pm)
+// findUploaded find a copy of the file uploaded by this bot in channel history.
+// Uploads have no metadata, so it's matched by uploaded name and size.
+func (b *RelayBot) findUploaded(e *outboxEntry) (bool, error) {
+	messages, err := b.api.fetchHistory(e.Channel, strconv.FormatInt(e.Time-1, 10))
 	if err != nil {
-		logger.Warnf("%v", err)
-		return
+		return false, err
 	}
-	if !resp.Ok {
-		logger.Warnf("PostMessage error, %s", resp.Error)
-		return
+	for _, msg := range messages {
+		for _, f := range msg.Files {
+			if f.Name == "botupload-"+e.File.Name && f.Size == e.File.Size {
+				return true, nil
+			}
+		}
 	}
-	// message log
-	b.messageLog.add(pm.Channel, resp.Ts, originID)
-	logger.Debugf("relayed message %v", pm)
+	return false, nil
+}
+
+// ignoredMessage tests the message is never relayed
+func ignoredMessage(msg *message) bool {
+	switch msg.SubType {
+	case "bot_message":
+		return true
+	case "message_replied":
+		// thread reply notification to parent, replies are handled by itself
+		return true
+	case "file_share":
+		return strings.Contains(msg.Text, "botupload-")
+	}
+	return false
 }
 
 // Handle receive message
 func (b *RelayBot) handleMessage(msg *message) {
 	// for debugging
-	//if b.relayGroup.hasChannel(msg.Channel) {
+	//if b.relayGroups.hasChannel(msg.Channel) {
 	//	logger.Infof("under haven message: %#v", msg)
 	//}
 
@@ -234,28 +656,39 @@ func (b *RelayBot) handleMessage(msg *message) {
 		return
 	}
 
-	if msg.SubType == "bot_message" {
+	b.seen(msg.Channel, msg.Ts)
+
+	if ignoredMessage(msg) {
 		return
 	}
 
-	if msg.SubType == "file_share" && strings.Contains(msg.Text, "botupload-") {
+	if b.handleCommand(msg) {
 		return
 	}
 
-	if strings.HasPrefix(strings.ToLower(msg.Text), "haven") {
-		b.handleSystemMessage(msg)
+	b.relayNewMessage(msg, false)
+}
+
+// relayNewMessage relay a message to other channels.
+// delayed message is caught up after disconnection, it's marked on sender name.
+func (b *RelayBot) relayNewMessage(msg *message, delayed bool) {
+	if b.state.paused() {
 		return
 	}
-
-	relayTo := b.relayGroup.determineRelayChannels(msg.Channel)
+	relayTo := b.relayGroups.determineRelayChannels(msg.Channel)
 	if relayTo == nil {
 		return
 	}
+
+	// same message may be received again by catch-up or retried events api request
+	if b.messageLog.isOrigin(msg.Channel, msg.Ts) {
+		return
+	}
 	logger.Infof("to relay message %+v", *msg)
 
-	sender, ok := b.users[msg.User]
-	if !ok {
-		logger.Warnf("User outdated. %+v", msg)
+	sender, err := b.users.get(msg.User)
+	if err != nil {
+		logger.Warnf("User unknown. %v %+v", err, msg)
 		return
 	}
 	// Add message log as origin
@@ -265,6 +698,9 @@ func (b *RelayBot) handleMessage(msg *message) {
 	if uname == "" {
 		uname = sender.Name
 	}
+	if delayed {
+		uname += DelayedSuffix
+	}
 
 	pm := postMessageRequest{
 		Text:        msg.Text,
@@ -276,15 +712,110 @@ func (b *RelayBot) handleMessage(msg *message) {
 		Attachments: msg.Attachments,
 	}
 
+	threadOrigin := b.threadOrigin(msg)
+	if msg.SubType == "thread_broadcast" {
+		pm.ReplyBroadcast = true
+	}
+
 	for _, channel := range relayTo {
-		pm.Channel = channel
-		go b.relayMessage(msg.Ts, pm)
+		b.deliver(&outboxEntry{
+			Kind:         outboxPost,
+			Channel:      channel,
+			OriginID:     msg.Ts,
+			ThreadOrigin: threadOrigin,
+			Post:         &pm,
+		})
+	}
+}
+
+// seen record the latest message ts of a relay channel
+func (b *RelayBot) seen(channelID, ts string) {
+	if ts == "" || !b.relayGroups.hasChannel(channelID) {
+		return
+	}
+	if err := b.lastSeen.update(channelID, ts); err != nil {
+		logger.Warnf("cant save last seen: %v", err)
+	}
+}
+
+// missedMessages is history of a relay channel posted after oldest
+type missedMessages struct {
+	channelID string
+	oldest    string
+	messages  []message
+}
+
+// catchUp fetch messages posted after last seen in each relay channel.
+// History is fetched in background not to block event loop, and relayed by relayMissed.
+func (b *RelayBot) catchUp(ctx context.Context) {
+	limit := formatTs(time.Now().Add(-MaxCatchUpAge))
+	targets := []*missedMessages{}
+	for _, channelID := range b.relayGroups.channelIDs() {
+		oldest := b.lastSeen.get(channelID)
+		if oldest == "" {
+			// first connection, nothing is missed
+			b.seen(channelID, formatTs(time.Now()))
+			continue
+		}
+		if compareTs(oldest, limit) < 0 {
+			oldest = limit
+		}
+		targets = append(targets, &missedMessages{channelID: channelID, oldest: oldest})
+	}
+	if len(targets) == 0 {
+		return
 	}
+	go func() {
+		for _, m := range targets {
+			messages, err := b.api.fetchHistory(m.channelID, m.oldest)
+			if err != nil {
+				logger.Warnf("cant fetch history of %s: %v", m.channelID, err)
+				continue
+			}
+			m.messages = messages
+			select {
+			case b.missed <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// relayMissed relay messages fetched by catch-up in posted order, marked as delayed
+func (b *RelayBot) relayMissed(m *missedMessages) {
+	for i := range m.messages {
+		msg := &m.messages[i]
+		// history returns newer messages than oldest, but exclude it explicitly
+		if compareTs(msg.Ts, m.oldest) <= 0 {
+			continue
+		}
+		msg.Channel = m.channelID
+		b.seen(m.channelID, msg.Ts)
+		if ignoredMessage(msg) || b.isCommand(msg.Text) {
+			// missed commands aren't answered
+			continue
+		}
+		b.relayNewMessage(msg, true)
+	}
+}
+
+// threadOrigin resolve origin id of thread parent.
+// empty means the message is not a thread reply or the parent is unknown.
+func (b *RelayBot) threadOrigin(msg *message) string {
+	if !msg.isThreadReply() {
+		return ""
+	}
+	origin := b.messageLog.originOf(msg.Channel, msg.ThreadTs)
+	if origin == "" {
+		logger.Debugf("thread parent is unknown. relay as top level %+v", *msg)
+	}
+	return origin
 }
 
 func (b *RelayBot) handleMessageChanged(ev *messageChanged) {
 	// for debugging
-	//if b.relayGroup.hasChannel(ev.Channel) {
+	//if b.relayGroups.hasChannel(ev.Channel) {
 	//	logger.Infof("under haven message changed: %#v", ev)
 	//}
 
@@ -292,48 +823,86 @@ func (b *RelayBot) handleMessageChanged(ev *messageChanged) {
 		return
 	}
 
-	if ev.Message.SubType == "bot_message" {
+	if ev.Message.SubType == "bot_message" || b.state.paused() {
 		return
 	}
 
-	relayTo := b.relayGroup.determineRelayChannels(ev.Channel)
+	relayTo := b.relayGroups.determineRelayChannels(ev.Channel)
 	if relayTo == nil {
 		return
 	}
 
-	messageMap := b.messageLog.getMessageMap(ev.Channel, ev.Message.Ts)
-	if messageMap == nil {
+	originID := b.messageLog.originOf(ev.Channel, ev.Message.Ts)
+	if originID == "" {
 		return
 	}
 
+	messageUpdateRequest := messageUpdateRequest{
+		Text: ev.Message.Text,
+	}
+	if ev.Message.Attachments != nil {
+		messageUpdateRequest.Attachments = ev.Message.Attachments
+	}
 	for _, relayChannelID := range relayTo {
-		msgID, ok := messageMap[relayChannelID]
-		if !ok {
-			continue
-		}
+		b.deliver(&outboxEntry{
+			Kind:     outboxUpdate,
+			Channel:  relayChannelID,
+			OriginID: originID,
+			Update:   &messageUpdateRequest,
+		})
+	}
+}
 
-		messageUpdateRequest := messageUpdateRequest{
-			Channel: relayChannelID,
-			Text:    ev.Message.Text,
-			Ts:      msgID,
-		}
-		if ev.Message.Attachments != nil {
-			messageUpdateRequest.Attachments = ev.Message.Attachments
-		}
-		_, err := updateMessage(b.config.Token, messageUpdateRequest)
-		if err != nil {
-			logger.Warnf("cant send reaction: %v", err)
+// Handle message deleted event.
+// Deleting origin deletes relayed copies.
+// Deleting a copy deletes the origin and other copies only if DeleteOrigin is configured.
+func (b *RelayBot) handleMessageDeleted(ev *messageDeleted) {
+	if b.deleting.remove(ev.Channel, ev.DeletedTs) {
+		// deleted by this bot
+		b.messageLog.forget(ev.Channel, ev.DeletedTs)
+		return
+	}
+	if b.state.paused() || !b.relayGroups.hasChannel(ev.Channel) {
+		return
+	}
+
+	originID := b.messageLog.originOf(ev.Channel, ev.DeletedTs)
+	if originID == "" {
+		return
+	}
+
+	isOrigin := b.messageLog.isOrigin(ev.Channel, ev.DeletedTs)
+	// Forget deleted message, later edits and reactions of it are never relayed
+	b.messageLog.forget(ev.Channel, ev.DeletedTs)
+	if !isOrigin && !b.config.DeleteOrigin {
+		return
+	}
+	logger.Infof("to delete message %+v", *ev)
+
+	// copies may be still in delivery queues of relay channels
+	targets := map[string]struct{}{}
+	for channelID := range b.messageLog.getOriginMap(originID) {
+		targets[channelID] = struct{}{}
+	}
+	for _, channelID := range b.relayGroups.determineRelayChannels(ev.Channel) {
+		targets[channelID] = struct{}{}
+	}
+
+	for channelID := range targets {
+		if channelID == ev.Channel {
+			continue
 		}
+		b.deliver(&outboxEntry{Kind: outboxDelete, Channel: channelID, OriginID: originID})
 	}
 }
 
 // Handle file shared event
 func (b *RelayBot) handleFileShared(ev *fileShared) {
-	if !b.relayGroup.hasUser(ev.UserID) {
+	if b.state.paused() || !b.relayGroups.hasUser(ev.UserID) {
 		return
 	}
 
-	file, err := fetchFileInfo(b.config.Token, ev.FileID)
+	file, err := b.api.fetchFileInfo(ev.FileID)
 	if err != nil {
 		logger.Warnf("%v", err)
 		return
@@ -346,64 +915,138 @@ func (b *RelayBot) handleFileShared(ev *fileShared) {
 	shared := append(file.Channels, file.Groups...)
 	shared = append(shared, file.IMS...)
 
-	relayTo := b.relayGroup.determineRelayChannelsMulti(shared)
+	relayTo := b.relayGroups.determineRelayChannelsMulti(shared)
 	if relayTo == nil {
 		return
 	}
 
 	logger.Infof("to handle file %v", *ev)
 
-	if _, ok := b.users[file.User]; !ok {
-		logger.Warnf("User outdated. %+v", file)
+	if _, err := b.users.get(file.User); err != nil {
+		logger.Warnf("User unknown. %v %+v", err, file)
 		return
 	}
 
-	fileContent, err := downloadFile(b.config.Token, file.URLPrivate)
-	if err != nil {
-		logger.Warnf("%s", err)
-		return
+	// upload per channel keeps order with other messages.
+	// The file is downloaded by delivery task, not to block event loop.
+	for _, channelID := range relayTo {
+		b.deliver(&outboxEntry{
+			Kind:    outboxUpload,
+			Channel: channelID,
+			File:    file,
+		})
 	}
+}
 
-	err = uploadFile(b.config.Token, relayTo, fileContent, file)
-	if err != nil {
-		logger.Warnf("%s", err)
-		return
+// reactionTargets determine origin id of the reacted message and channels to react.
+func (b *RelayBot) reactionTargets(user, itemType, channelID, ts string) (string, []string) {
+	if b.state.paused() {
+		return "", nil
+	}
+	// skip reaction posted by this bot
+	if user == b.hubUser.ID {
+		return "", nil
 	}
+
+	relayTo := b.relayGroups.determineRelayChannels(channelID)
+	if relayTo == nil {
+		return "", nil
+	}
+
+	// supports only message
+	if itemType != "message" {
+		return "", nil
+	}
+
+	originID := b.messageLog.originOf(channelID, ts)
+	if originID == "" {
+		return "", nil
+	}
+	return originID, relayTo
 }
 
 func (b *RelayBot) handleReactionAdded(ev *reactionAdded) {
-	// skip reaction posted by this bot
+	originID, relayTo := b.reactionTargets(ev.User, ev.Item.Type, ev.Item.Channel, ev.Item.Ts)
+	for _, channelID := range relayTo {
+		b.deliver(&outboxEntry{
+			Kind:     outboxReactionAdd,
+			Channel:  channelID,
+			OriginID: originID,
+			Reaction: ev.Reaction,
+		})
+	}
+}
+
+func (b *RelayBot) handleReactionRemoved(ev *reactionRemoved) {
+	originID, relayTo := b.reactionTargets(ev.User, ev.Item.Type, ev.Item.Channel, ev.Item.Ts)
+	for _, channelID := range relayTo {
+		b.deliver(&outboxEntry{
+			Kind:     outboxReactionRemove,
+			Channel:  channelID,
+			OriginID: originID,
+			Reaction: ev.Reaction,
+		})
+	}
+}
+
+// Handle team_join and user_change event
+func (b *RelayBot) handleUserChange(ev *userChange) {
+	b.users.set(ev.User)
+}
+
+// Handle member_joined_channel event
+func (b *RelayBot) handleMemberJoined(ev *memberChannelEvent) {
 	if ev.User == b.hubUser.ID {
+		b.joinChannel(ev.Channel)
 		return
 	}
-
-	relayTo := b.relayGroup.determineRelayChannels(ev.Item.Channel)
-	if relayTo == nil {
+	if !b.relayGroups.hasChannel(ev.Channel) {
 		return
 	}
+	logger.Infof("member joined %+v", *ev)
+	b.relayGroups.addMember(ev.Channel, ev.User)
+}
 
-	// supports only message
-	if ev.Item.Type != "message" {
+// Handle member_left_channel event
+func (b *RelayBot) handleMemberLeft(ev *memberChannelEvent) {
+	if ev.User == b.hubUser.ID {
+		b.leaveChannel(ev.Channel)
 		return
 	}
-
-	messageMap := b.messageLog.getMessageMap(ev.Item.Channel, ev.Item.Ts)
-	if messageMap == nil {
+	if !b.relayGroups.hasChannel(ev.Channel) {
 		return
 	}
+	logger.Infof("member left %+v", *ev)
+	b.relayGroups.removeMember(ev.Channel, ev.User)
+}
 
-	requestPayload := reactionAddRequest{Name: ev.Reaction}
-	for _, relayChannelID := range relayTo {
-		if _, ok := messageMap[relayChannelID]; !ok {
-			continue
-		}
-		requestPayload.Channel = relayChannelID
-		requestPayload.Timestamp = messageMap[relayChannelID]
-		_, err := addReaction(b.config.Token, requestPayload)
-		if err != nil {
-			logger.Warnf("cant update message: %v", err)
+// joinChannel add a channel which this bot joined to configured groups
+func (b *RelayBot) joinChannel(cID string) {
+	configured := false
+	for _, rooms := range b.config.RelayGroups {
+		if _, ok := rooms[cID]; ok {
+			configured = true
 		}
 	}
+	if !configured {
+		return
+	}
+	members, err := b.api.fetchConversationMembers(cID)
+	if err != nil {
+		logger.Warnf("cant fetch members of %s: %v", cID, err)
+		return
+	}
+	logger.Infof("joined relay channel %s", cID)
+	b.relayGroups.addChannel(b.config, channel{ID: cID, Members: members})
+}
+
+// leaveChannel remove a channel which this bot left from groups
+func (b *RelayBot) leaveChannel(cID string) {
+	if !b.relayGroups.hasChannel(cID) {
+		return
+	}
+	logger.Infof("left relay channel %s", cID)
+	b.relayGroups.removeChannel(cID)
 }
 
 // Handle receive event
@@ -421,6 +1064,16 @@ func (b *RelayBot) handleEvent(ev *anyEvent) {
 			b.handleMessageChanged(&msgChangedEvent)
 			return
 		}
+		// message deleted event
+		if ev.SubType == "message_deleted" {
+			var msgDeletedEvent messageDeleted
+			if err := json.Unmarshal(ev.jsonMsg, &msgDeletedEvent); err != nil {
+				logger.Warnf("%v", err)
+				return
+			}
+			b.handleMessageDeleted(&msgDeletedEvent)
+			return
+		}
 		var msgEv message
 		if err := json.Unmarshal(ev.jsonMsg, &msgEv); err != nil {
 			logger.Warnf("%v", err)
@@ -443,80 +1096,231 @@ func (b *RelayBot) handleEvent(ev *anyEvent) {
 			return
 		}
 		b.handleReactionAdded(&reactionAddEv)
-	case "pong":
-		logger.Debugf("pong received %v", string(ev.jsonMsg))
+	case "reaction_removed":
+		logger.Debugf("reaction removed %v", string(ev.jsonMsg))
+		var reactionRemoveEv reactionRemoved
+		if err := json.Unmarshal(ev.jsonMsg, &reactionRemoveEv); err != nil {
+			logger.Warnf("%v", err)
+			return
+		}
+		b.handleReactionRemoved(&reactionRemoveEv)
+	case "team_join", "user_change":
+		var userEv userChange
+		if err := json.Unmarshal(ev.jsonMsg, &userEv); err != nil {
+			logger.Warnf("%v", err)
+			return
+		}
+		b.handleUserChange(&userEv)
+	case "member_joined_channel", "member_left_channel":
+		logger.Debugf("member event received %v", string(ev.jsonMsg))
+		var memberEv memberChannelEvent
+		if err := json.Unmarshal(ev.jsonMsg, &memberEv); err != nil {
+			logger.Warnf("%v", err)
+			return
+		}
+		if ev.Type == "member_joined_channel" {
+			b.handleMemberJoined(&memberEv)
+		} else {
+			b.handleMemberLeft(&memberEv)
+		}
+	case "channel_joined", "group_joined":
+		var joinedEv channelJoined
+		if err := json.Unmarshal(ev.jsonMsg, &joinedEv); err != nil {
+			logger.Warnf("%v", err)
+			return
+		}
+		b.joinChannel(joinedEv.Channel.ID)
+	case "channel_left", "group_left":
+		var leftEv channelLeft
+		if err := json.Unmarshal(ev.jsonMsg, &leftEv); err != nil {
+			logger.Warnf("%v", err)
+			return
+		}
+		b.leaveChannel(leftEv.Channel)
 	default:
 		// logger.Debugf("unhandled event %v %v", ev.EventType, string(ev.jsonMsg))
 	}
 }
 
-// setUsers set user list under bot control
-func (b *RelayBot) setUsers(users []user) {
-	b.users = make(map[string]user, len(users))
-	for _, u := range users {
-		b.users[u.ID] = u
+// fetchRelayChannels fetch members of channels in relay groups.
+// Channels which can't be fetched are skipped.
+func (b *RelayBot) fetchRelayChannels(config *Config) []channel {
+	ids := map[string]struct{}{}
+	for _, rooms := range config.RelayGroups {
+		for id := range rooms {
+			ids[id] = struct{}{}
+		}
 	}
-}
 
-func (b *RelayBot) _connect() error {
-	logger.Info("Call start api")
-	res, err := startAPI(b.config.Token)
-	if err != nil {
-		return err
+	channels := make([]channel, 0, len(ids))
+	for id := range ids {
+		members, err := b.api.fetchConversationMembers(id)
+		if err != nil {
+			logger.Warnf("cant fetch members of %s: %v", id, err)
+			continue
+		}
+		channels = append(channels, channel{ID: id, Members: members})
 	}
-	b.url = res.URL
-	all := append(res.Channels, res.Groups...)
-	b.relayGroup = newRelayGroup(b.config, all)
-	b.setUsers(res.Users)
-	b.hubUser = res.Self
-	logger.Info("Connect ws")
-	err = b.ws.Connect(b.url)
+	return channels
+}
+
+func (b *RelayBot) _connect(ctx context.Context) error {
+	hubUser, err := b.transport.connect(ctx)
 	if err != nil {
 		return err
 	}
+	b.hubUser = *hubUser
+	b.relayGroups = newRelayGroups(b.config, b.fetchRelayChannels(b.config))
+	b.users.reset()
+	b.catchUp(ctx)
 	return nil
 }
 
-// connect to slack websocket.
-// Try until connection establish
-func (b *RelayBot) connect() {
-	if err := b._connect(); err != nil {
+// connect to slack.
+// Try with backoff until connection establish, attempts reach ReconnectMaxAttempts or ctx is done.
+func (b *RelayBot) connect(ctx context.Context) error {
+	policy := newBackoff(b.config.ReconnectMinWait, b.config.ReconnectMaxWait)
+	b.conn.set(StateConnecting, nil)
+	for attempt := 1; ; attempt++ {
+		err := b._connect(ctx)
+		if err == nil {
+			b.conn.set(StateConnected, nil)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		logger.Warnf("%v", err)
-	} else {
-		return
+		if b.config.ReconnectMaxAttempts > 0 && attempt >= b.config.ReconnectMaxAttempts {
+			b.conn.set(StateStopped, err)
+			return fmt.Errorf("give up connecting after %d attempts: %v", attempt, err)
+		}
+		b.conn.set(StateDegraded, err)
+		wait := policy.next()
+		logger.Infof("retry connecting after %v", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		b.conn.set(StateConnecting, nil)
 	}
+}
 
-	// retry loop
-	t := time.NewTicker(ReconnectInterval)
-	defer t.Stop()
-	for range t.C {
-		if err := b._connect(); err != nil {
-			logger.Warnf("%v", err)
-			continue
+// Reload apply relay groups and delete-origin of config without reconnecting.
+// Config is applied by event loop, pending older config is replaced.
+// Other options need restart.
+func (b *RelayBot) Reload(config *Config) {
+	for {
+		select {
+		case b.reloads <- config:
+			return
+		default:
 		}
-		return
+		select {
+		case <-b.reloads:
+		default:
+		}
+	}
+}
+
+// applyConfig swap relay groups with ones of config.
+// It runs on event loop, so handlers never see half applied groups.
+func (b *RelayBot) applyConfig(config *Config) {
+	next := *b.config
+	next.RelayGroups = config.RelayGroups
+	next.DeleteOrigin = config.DeleteOrigin
+	if !reflect.DeepEqual(&next, config) {
+		logger.Warn("Options other than relay groups and delete-origin are applied after restart")
 	}
+	b.config = &next
+	b.configGroups = config.RelayGroups
+	b.applyRelayState()
+	logger.Infof("Config reloaded. relay groups %v", b.relayGroups.names())
+}
+
+// applyRelayState rebuild relay groups from config and changes by admin commands
+func (b *RelayBot) applyRelayState() {
+	next := *b.config
+	next.RelayGroups = b.state.apply(b.configGroups)
+	b.config = &next
+	b.relayGroups = newRelayGroups(b.config, b.fetchRelayChannels(b.config))
 }
 
-// Start relay bot
-func (b *RelayBot) Start() {
+// ConnectionStatus return current connection state
+func (b *RelayBot) ConnectionStatus() ConnectionStatus {
+	return b.conn.get()
+}
+
+// shutdown close connection, wait for pending deliveries and close stores
+func (b *RelayBot) shutdown() {
+	if b.admin != nil {
+		b.admin.close()
+	}
+	b.transport.close()
+	b.conn.set(StateStopped, nil)
+
+	timeout := b.config.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	logger.Infof("Wait for deliveries up to %v", timeout)
+	if err := b.delivery.drain(timeout); err != nil {
+		logger.Warnf("%v", err)
+	}
+	if err := b.messageLog.close(); err != nil {
+		logger.Warnf("cant close message log: %v", err)
+	}
+	if err := b.outbox.close(); err != nil {
+		logger.Warnf("cant close outbox: %v", err)
+	}
+	logger.Info("Relay bot stopped")
+}
+
+// Start relay bot. It runs until ctx is done or connecting is given up.
+// Pending deliveries are drained before return.
+// It returns ctx.Err() when ctx is done.
+func (b *RelayBot) Start(ctx context.Context) error {
 	logger.Info("Relay bot start")
-	b.connect()
-	defer b.ws.Close()
+	defer b.shutdown()
+	if b.config.AdminAddr != "" {
+		admin, err := startAdminServer(b.config.AdminAddr, b.adminHandler())
+		if err != nil {
+			return err
+		}
+		b.admin = admin
+	}
+	b.replayOutbox()
+	if err := b.connect(ctx); err != nil {
+		return err
+	}
 
 	for {
 		select {
-		case ev := <-b.ws.Receive:
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev := <-b.transport.receive():
 			var e anyEvent
 			if err := json.Unmarshal(ev, &e); err != nil {
 				logger.Warnf("%v", err)
 				continue
 			}
 			e.jsonMsg = json.RawMessage(ev)
+			b.metrics.eventReceived(e.Type)
 			b.handleEvent(&e)
-		case err := <-b.ws.Disconnect:
+		case config := <-b.reloads:
+			b.applyConfig(config)
+		case m := <-b.missed:
+			b.relayMissed(m)
+		case err := <-b.transport.disconnect():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			logger.Errorf("Disconnected. Cause %v", err)
-			b.connect()
+			b.metrics.reconnected()
+			if err := b.connect(ctx); err != nil {
+				return err
+			}
 		}
 	}
 }
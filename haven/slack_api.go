@@ -3,194 +3,526 @@ package haven
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	rtmStartURL      = "https://slack.com/api/rtm.start"
-	postMessageURL   = "https://slack.com/api/chat.postMessage"
-	uploadFileURL    = "https://slack.com/api/files.upload"
-	fileInfoURL      = "https://slack.com/api/files.info"
-	reactionAddURL   = "https://slack.com/api/reactions.add"
-	updateMessageURL = "https://slack.com/api/chat.update"
+	slackAPIBaseURL = "https://slack.com/api/"
+
+	// APITimeout is timeout of a slack api call
+	APITimeout = time.Second * 30
+	// FileAPITimeout is timeout of file upload and download
+	FileAPITimeout = time.Minute * 5
+	// MaxAPIRetries is max retry count of a slack api call
+	MaxAPIRetries = 3
+	// APIRetryWait is first backoff of retrying network and server errors
+	APIRetryWait = time.Second
 )
 
-func callSlackJSONAPI(url string, token string, payload interface{}) ([]byte, error) {
-	jsonBytes, err := json.Marshal(payload)
-	if err != nil {
-		return nil, err
-	}
-	jsonReader := bytes.NewReader(jsonBytes)
-	req, err := http.NewRequest("POST", url, jsonReader)
-	if err != nil {
-		return nil, err
+// Rate limit tiers, calls per minute
+const (
+	tier1 = 1
+	tier2 = 20
+	tier3 = 50
+	tier4 = 100
+)
+
+type apiMethod struct {
+	tier int
+	// idempotent method is retried on network and server errors
+	idempotent bool
+}
+
+var apiMethods = map[string]apiMethod{
+	"rtm.connect":           {tier1, true},
+	"apps.connections.open": {tier1, true},
+	"auth.test":             {tier4, true},
+	"conversations.members": {tier4, true},
+	"conversations.history": {tier3, true},
+	"conversations.replies": {tier3, true},
+	"users.info":            {tier4, true},
+	"files.info":            {tier4, true},
+	"chat.postMessage":      {tier4, false},
+	"chat.postEphemeral":    {tier4, false},
+	"chat.update":           {tier3, true},
+	"chat.delete":           {tier3, true},
+	"reactions.add":         {tier3, true},
+	"reactions.remove":      {tier2, true},
+	"files.upload":          {tier2, false},
+}
+
+// APIError is error response of slack web api
+type APIError struct {
+	Method string
+	// Code is error field of slack response, such as channel_not_found
+	Code string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Method, e.Code)
+}
+
+// HTTPError is unexpected http status of slack web api
+type HTTPError struct {
+	Method     string
+	StatusCode int
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s: http status %d", e.Method, e.StatusCode)
+}
+
+// RateLimitedError is returned when retries are exhausted by rate limiting
+type RateLimitedError struct {
+	Method     string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("%s: ratelimited, retry after %v", e.Method, e.RetryAfter)
+}
+
+// isTemporary tests the error may be resolved by calling again later.
+// Error responses of slack are permanent.
+func isTemporary(err error) bool {
+	switch e := err.(type) {
+	case *RateLimitedError:
+		return true
+	case *HTTPError:
+		return e.StatusCode >= 500
+	case net.Error:
+		return true
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-	client := http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	return false
+}
+
+// isAPIError tests the error is slack error response of one of codes
+func isAPIError(err error, codes ...string) bool {
+	e, ok := err.(*APIError)
+	if !ok {
+		return false
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
+	for _, code := range codes {
+		if e.Code == code {
+			return true
+		}
 	}
-	return body, nil
+	return false
 }
 
-// startAPI call slack rtm.start api
-func startAPI(token string) (resp *rtmStartResponse, err error) {
-	payload := rtmStartRequest{SimpleLatest: true, NoUnreads: true}
-	responseBytes, err := callSlackJSONAPI(rtmStartURL, token, payload)
-	slackResponse := rtmStartResponse{}
-	if err = json.Unmarshal(responseBytes, &slackResponse); err != nil {
-		return nil, err
+// rateLimiter spaces calls of a method with bursts.
+// It's a generic cell rate algorithm.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	tat      time.Time // theoretical arrival time
+	now      func() time.Time
+}
+
+func newRateLimiter(perMinute int, now func() time.Time) *rateLimiter {
+	burst := perMinute / 10
+	if burst < 1 {
+		burst = 1
 	}
-	if !slackResponse.Ok {
-		return nil, errors.New(slackResponse.Error)
+	return &rateLimiter{
+		interval: time.Minute / time.Duration(perMinute),
+		burst:    burst,
+		now:      now,
 	}
-	// sort members
-	for _, c := range slackResponse.Channels {
-		sort.Strings(c.Members)
+}
+
+// reserve a call and return how long to wait before calling
+func (l *rateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.tat.Before(now) {
+		l.tat = now
 	}
-	for _, c := range slackResponse.Groups {
-		sort.Strings(c.Members)
+	wait := l.tat.Sub(now) - l.interval*time.Duration(l.burst-1)
+	if wait < 0 {
+		wait = 0
 	}
+	l.tat = l.tat.Add(l.interval)
+	return wait
+}
 
-	return &slackResponse, nil
+// pause next calls for d
+func (l *rateLimiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tat := l.now().Add(d + l.interval*time.Duration(l.burst-1))
+	if tat.After(l.tat) {
+		l.tat = tat
+	}
 }
 
-// postMessage send a message to slack throw chat.postMessage API
-func postMessage(token string, pm postMessageRequest) (*postMessageResponse, error) {
-	responseBytes, err := callSlackJSONAPI(postMessageURL, token, pm)
-	slackResponse := postMessageResponse{}
-	if err = json.Unmarshal(responseBytes, &slackResponse); err != nil {
-		return nil, err
+// apiClient calls slack web api with rate limiting and retries.
+// It's shared by all api calls of a token.
+type apiClient struct {
+	token      string
+	baseURL    string
+	client     *http.Client
+	fileClient *http.Client
+	maxRetries int
+	retryWait  time.Duration
+	limiters   map[string]*rateLimiter
+	mu         sync.Mutex
+	now        func() time.Time
+	sleep      func(time.Duration)
+	// observe is called after each api call if set
+	observe func(method string, elapsed time.Duration, err error)
+}
+
+func newAPIClient(token string) *apiClient {
+	return &apiClient{
+		token:      token,
+		baseURL:    slackAPIBaseURL,
+		client:     &http.Client{Timeout: APITimeout},
+		fileClient: &http.Client{Timeout: FileAPITimeout},
+		maxRetries: MaxAPIRetries,
+		retryWait:  APIRetryWait,
+		limiters:   map[string]*rateLimiter{},
+		now:        time.Now,
+		sleep:      time.Sleep,
 	}
-	if !slackResponse.Ok {
-		return nil, errors.New(slackResponse.Error)
+}
+
+// limiter return rate limiter of the method
+func (c *apiClient) limiter(method string, tier int) *rateLimiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.limiters[method]
+	if !ok {
+		l = newRateLimiter(tier, c.now)
+		c.limiters[method] = l
 	}
-	return &slackResponse, nil
+	return l
 }
 
-// add reaction
-func addReaction(token string, ra reactionAddRequest) (*slackOk, error) {
-	responseBytes, err := callSlackJSONAPI(reactionAddURL, token, ra)
-	slackResponse := slackOk{}
-	if err = json.Unmarshal(responseBytes, &slackResponse); err != nil {
-		return nil, err
+// parseRetryAfter parse Retry-After header in seconds
+func parseRetryAfter(h http.Header) time.Duration {
+	sec, err := strconv.Atoi(h.Get("Retry-After"))
+	if err != nil || sec < 0 {
+		return time.Second
 	}
-	if !slackResponse.Ok {
-		return nil, errors.New(slackResponse.Error)
+	return time.Second * time.Duration(sec)
+}
+
+// call a slack api method. newRequest is called for each attempt.
+// Response is decoded to result if result isn't nil.
+func (c *apiClient) call(method string, client *http.Client, newRequest func(string) (*http.Request, error), result interface{}) error {
+	start := time.Now()
+	err := c.callWithRetry(method, client, newRequest, result)
+	if c.observe != nil {
+		c.observe(method, time.Since(start), err)
 	}
-	return &slackResponse, nil
+	return err
 }
 
-// update chat message
-func updateMessage(token string, mur messageUpdateRequest) (*slackOk, error) {
-	responseBytes, err := callSlackJSONAPI(updateMessageURL, token, mur)
-	slackResponse := slackOk{}
-	if err = json.Unmarshal(responseBytes, &slackResponse); err != nil {
-		return nil, err
+func (c *apiClient) callWithRetry(method string, client *http.Client, newRequest func(string) (*http.Request, error), result interface{}) error {
+	spec, ok := apiMethods[method]
+	if !ok {
+		spec = apiMethod{tier: tier3}
 	}
-	if !slackResponse.Ok {
-		return nil, errors.New(slackResponse.Error)
+	limiter := c.limiter(method, spec.tier)
+	backoff := c.retryWait
+
+	var lastErr error
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		c.sleep(limiter.reserve())
+
+		req, err := newRequest(c.baseURL + method)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+
+		res, err := client.Do(req)
+		if err != nil {
+			if !spec.idempotent {
+				return err
+			}
+			lastErr = err
+			logger.Warnf("%s failed, retry after %v: %v", method, backoff, err)
+			c.sleep(backoff)
+			backoff *= 2
+			continue
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case res.StatusCode == http.StatusTooManyRequests:
+			retryAfter := parseRetryAfter(res.Header)
+			lastErr = &RateLimitedError{Method: method, RetryAfter: retryAfter}
+			logger.Warnf("%v", lastErr)
+			// rate limited request is never processed, retry is safe
+			limiter.pause(retryAfter)
+			continue
+		case res.StatusCode >= 500:
+			lastErr = &HTTPError{Method: method, StatusCode: res.StatusCode}
+			if !spec.idempotent {
+				return lastErr
+			}
+			logger.Warnf("%v, retry after %v", lastErr, backoff)
+			c.sleep(backoff)
+			backoff *= 2
+			continue
+		case res.StatusCode != http.StatusOK:
+			return &HTTPError{Method: method, StatusCode: res.StatusCode}
+		}
+
+		ok := slackOk{}
+		if err := json.Unmarshal(body, &ok); err != nil {
+			return err
+		}
+		if !ok.Ok {
+			return &APIError{Method: method, Code: ok.Error}
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(body, result)
 	}
-	return &slackResponse, nil
+	return lastErr
 }
 
-func downloadFile(token, url string) (rc []byte, err error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-	req.Header.Add("Authorization", "Bearer "+token)
-	resp, err := client.Do(req)
+// callJSON call slack api with json body
+func (c *apiClient) callJSON(method string, payload interface{}, result interface{}) error {
+	jsonBytes, err := json.Marshal(payload)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	content, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	return c.call(method, c.client, func(url string) (*http.Request, error) {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(jsonBytes))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}, result)
+}
+
+// callGet call slack api with query parameters
+func (c *apiClient) callGet(method string, params url.Values, result interface{}) error {
+	return c.call(method, c.client, func(url string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.URL.RawQuery = params.Encode()
+		return req, nil
+	}, result)
+}
+
+// connectRTM call slack rtm.connect api
+func (c *apiClient) connectRTM() (*rtmConnectResponse, error) {
+	slackResponse := rtmConnectResponse{}
+	if err := c.callGet("rtm.connect", url.Values{}, &slackResponse); err != nil {
 		return nil, err
 	}
-	return content, nil
+	return &slackResponse, nil
 }
 
-func fetchFileInfo(token, id string) (f *slackFile, err error) {
-	req, err := http.NewRequest("GET", fileInfoURL, nil)
-	if err != nil {
+// authTest call slack auth.test api and return token owner
+func (c *apiClient) authTest() (*self, error) {
+	slackResponse := authTestResponse{}
+	if err := c.callGet("auth.test", url.Values{}, &slackResponse); err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+token)
-	q := req.URL.Query()
-	q.Add("file", id)
-	req.URL.RawQuery = q.Encode()
-	client := http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	return &self{ID: slackResponse.UserID, Name: slackResponse.User}, nil
+}
+
+// openConnection call slack apps.connections.open api. It requires app level token.
+func (c *apiClient) openConnection() (string, error) {
+	slackResponse := connectionsOpenResponse{}
+	if err := c.callJSON("apps.connections.open", struct{}{}, &slackResponse); err != nil {
+		return "", err
 	}
-	defer res.Body.Close()
-	responseBytes, err := ioutil.ReadAll(res.Body)
+	return slackResponse.URL, nil
+}
+
+// fetchConversationMembers call slack conversations.members api until all pages are read.
+// Returned member ids are sorted.
+func (c *apiClient) fetchConversationMembers(channelID string) ([]string, error) {
+	members := []string{}
+	params := url.Values{}
+	params.Set("channel", channelID)
+	params.Set("limit", "200")
+	for {
+		slackResponse := conversationMembersResponse{}
+		if err := c.callGet("conversations.members", params, &slackResponse); err != nil {
+			return nil, err
+		}
+		members = append(members, slackResponse.Members...)
+		if slackResponse.ResponseMetadata.NextCursor == "" {
+			break
+		}
+		params.Set("cursor", slackResponse.ResponseMetadata.NextCursor)
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// fetchHistory call slack conversations.history api until all pages are read.
+// Messages after oldest are returned in posted order.
+func (c *apiClient) fetchHistory(channelID, oldest string) ([]message, error) {
+	params := url.Values{}
+	params.Set("channel", channelID)
+	params.Set("oldest", oldest)
+	messages, err := c.fetchMessages("conversations.history", params)
 	if err != nil {
 		return nil, err
 	}
-	slackResponse := fileInfo{}
-	if err = json.Unmarshal(responseBytes, &slackResponse); err != nil {
-		return nil, err
+	// history is newest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
 	}
-	if !slackResponse.Ok {
-		return nil, errors.New(slackResponse.Error)
+	return messages, nil
+}
+
+// fetchReplies call slack conversations.replies api until all pages are read.
+// Replies of the thread after oldest are returned in posted order. History doesn't return them.
+func (c *apiClient) fetchReplies(channelID, threadTs, oldest string) ([]message, error) {
+	params := url.Values{}
+	params.Set("channel", channelID)
+	params.Set("ts", threadTs)
+	params.Set("oldest", oldest)
+	return c.fetchMessages("conversations.replies", params)
+}
+
+// fetchMessages call a paginated api returning messages until all pages are read
+func (c *apiClient) fetchMessages(method string, params url.Values) ([]message, error) {
+	messages := []message{}
+	params.Set("limit", "200")
+	params.Set("include_all_metadata", "true")
+	for {
+		slackResponse := conversationHistoryResponse{}
+		if err := c.callGet(method, params, &slackResponse); err != nil {
+			return nil, err
+		}
+		messages = append(messages, slackResponse.Messages...)
+		if !slackResponse.HasMore || slackResponse.ResponseMetadata.NextCursor == "" {
+			break
+		}
+		params.Set("cursor", slackResponse.ResponseMetadata.NextCursor)
 	}
-	return &slackResponse.File, nil
+	return messages, nil
 }
 
-// uploadFile send file to slack
-func uploadFile(token string, channels []string, content []byte, file *slackFile) error {
-	body := bytes.Buffer{}
-	writer := multipart.NewWriter(&body)
-	defer writer.Close()
+// fetchUserInfo call slack users.info api
+func (c *apiClient) fetchUserInfo(userID string) (*user, error) {
+	params := url.Values{}
+	params.Set("user", userID)
+	slackResponse := userInfoResponse{}
+	if err := c.callGet("users.info", params, &slackResponse); err != nil {
+		return nil, err
+	}
+	return &slackResponse.User, nil
+}
 
-	part, err := writer.CreateFormFile("file", file.Title)
-	if err != nil {
-		return err
+// postMessage send a message to slack throw chat.postMessage API
+func (c *apiClient) postMessage(pm postMessageRequest) (*postMessageResponse, error) {
+	slackResponse := postMessageResponse{}
+	if err := c.callJSON("chat.postMessage", pm, &slackResponse); err != nil {
+		return nil, err
 	}
+	return &slackResponse, nil
+}
+
+// post a message visible only to a user
+func (c *apiClient) postEphemeral(pe postEphemeralRequest) error {
+	return c.callJSON("chat.postEphemeral", pe, nil)
+}
+
+// add reaction
+func (c *apiClient) addReaction(ra reactionAddRequest) error {
+	return c.callJSON("reactions.add", ra, nil)
+}
 
-	part.Write(content)
-	_ = writer.WriteField("token", token)
-	_ = writer.WriteField("filetype", file.FileType)
-	_ = writer.WriteField("filename", "botupload-"+file.Name)
-	_ = writer.WriteField("channels", strings.Join(channels, ","))
+// remove reaction
+func (c *apiClient) removeReaction(rr reactionRemoveRequest) error {
+	return c.callJSON("reactions.remove", rr, nil)
+}
+
+// update chat message
+func (c *apiClient) updateMessage(mur messageUpdateRequest) error {
+	return c.callJSON("chat.update", mur, nil)
+}
 
-	req, err := http.NewRequest("POST", uploadFileURL, &body)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	client := &http.Client{}
+// delete chat message
+func (c *apiClient) deleteMessage(mdr messageDeleteRequest) error {
+	return c.callJSON("chat.delete", mdr, nil)
+}
 
-	resp, err := client.Do(req)
+func (c *apiClient) downloadFile(url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	// json check
-	respBody, err := ioutil.ReadAll(resp.Body)
+	req.Header.Add("Authorization", "Bearer "+c.token)
+	resp, err := c.fileClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	ok := &slackOk{}
-	if err := json.Unmarshal(respBody, ok); err != nil {
-		return err
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &HTTPError{Method: "download", StatusCode: resp.StatusCode}
 	}
+	return ioutil.ReadAll(resp.Body)
+}
 
-	if !ok.Ok {
-		return ok.NewError()
+func (c *apiClient) fetchFileInfo(id string) (*slackFile, error) {
+	params := url.Values{}
+	params.Set("file", id)
+	slackResponse := fileInfo{}
+	if err := c.callGet("files.info", params, &slackResponse); err != nil {
+		return nil, err
 	}
+	return &slackResponse.File, nil
+}
+
+// uploadFile send file to slack
+func (c *apiClient) uploadFile(channels []string, content []byte, file *slackFile) error {
+	return c.call("files.upload", c.fileClient, func(url string) (*http.Request, error) {
+		body := bytes.Buffer{}
+		writer := multipart.NewWriter(&body)
+
+		part, err := writer.CreateFormFile("file", file.Title)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(part, bytes.NewReader(content)); err != nil {
+			return nil, err
+		}
+		_ = writer.WriteField("filetype", file.FileType)
+		_ = writer.WriteField("filename", "botupload-"+file.Name)
+		_ = writer.WriteField("channels", strings.Join(channels, ","))
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
 
-	return nil
+		req, err := http.NewRequest("POST", url, &body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		return req, nil
+	}, nil)
 }
@@ -0,0 +1,106 @@
+package haven
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestAPIClient(handler http.HandlerFunc) (*apiClient, *[]time.Duration, func()) {
+	server := httptest.NewServer(handler)
+	c := newAPIClient("token")
+	c.baseURL = server.URL + "/"
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	slept := []time.Duration{}
+	c.sleep = func(d time.Duration) {
+		if d > 0 {
+			slept = append(slept, d)
+		}
+	}
+	return c, &slept, server.Close
+}
+
+func TestAPIClientRetryAfter(t *testing.T) {
+	calls := 0
+	c, slept, closer := newTestAPIClient(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Authorization header is wrong. %v", r.Header.Get("Authorization"))
+		}
+		if calls == 1 {
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"ok": false, "error": "ratelimited"}`))
+			return
+		}
+		w.Write([]byte(`{"ok": true, "ts": "1.2"}`))
+	})
+	defer closer()
+
+	res, err := c.postMessage(postMessageRequest{Channel: "C1", Text: "hi"})
+	if err != nil {
+		t.Fatalf("Expected success after retry. %v", err)
+	}
+	if res.Ts != "1.2" || calls != 2 {
+		t.Errorf("Expected retried once. calls: %v, response: %+v", calls, res)
+	}
+	if len(*slept) != 1 || (*slept)[0] < time.Second*3 {
+		t.Errorf("Expected wait for Retry-After. Actual: %v", *slept)
+	}
+}
+
+func TestAPIClientErrors(t *testing.T) {
+	calls := 0
+	c, _, closer := newTestAPIClient(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+		case "/chat.update":
+			w.Write([]byte(`{"ok": false, "error": "message_not_found"}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	})
+	defer closer()
+
+	err := c.updateMessage(messageUpdateRequest{Channel: "C1", Ts: "1.2"})
+	if apiErr, ok := err.(*APIError); !ok || apiErr.Code != "message_not_found" || apiErr.Method != "chat.update" {
+		t.Errorf("Expected APIError. Actual: %#v", err)
+	}
+
+	// not idempotent method is never retried
+	calls = 0
+	_, err = c.postMessage(postMessageRequest{Channel: "C1"})
+	if httpErr, ok := err.(*HTTPError); !ok || httpErr.StatusCode != http.StatusBadGateway || calls != 1 {
+		t.Errorf("Expected HTTPError without retry. calls: %v, err: %#v", calls, err)
+	}
+
+	// idempotent method is retried
+	calls = 0
+	err = c.deleteMessage(messageDeleteRequest{Channel: "C1", Ts: "1.2"})
+	if _, ok := err.(*HTTPError); !ok || calls != MaxAPIRetries+1 {
+		t.Errorf("Expected HTTPError after retries. calls: %v, err: %#v", calls, err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(60, func() time.Time { return now })
+
+	// burst of 6 calls are allowed
+	for i := 0; i < 6; i++ {
+		if wait := l.reserve(); wait != 0 {
+			t.Errorf("Expected no wait in burst. call: %v, wait: %v", i, wait)
+		}
+	}
+	if wait := l.reserve(); wait != time.Second {
+		t.Errorf("Expected wait 1s. Actual: %v", wait)
+	}
+
+	now = now.Add(time.Minute)
+	l.pause(time.Second * 30)
+	if wait := l.reserve(); wait != time.Second*30 {
+		t.Errorf("Expected wait 30s after pause. Actual: %v", wait)
+	}
+}
@@ -1,7 +1,10 @@
 package haven
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -14,15 +17,31 @@ const (
 	// ReadTimeout is WsClient's read timeout value
 	ReadTimeout  = time.Second * 65
 	pingInterval = time.Second * 60
+	pongTimeout  = time.Second * 30
+	writeTimeout = time.Second * 10
 )
 
-// WsClient is websocket client
+var (
+	errNotConnected = errors.New("websocket is not connected")
+	errClosed       = errors.New("websocket is closed")
+	errPongTimeout  = errors.New("pong is timed out")
+)
+
+// WsClient is websocket client.
+// Each connection has own read, write and keep alive goroutines, they stop when the connection is closed.
 type WsClient struct {
-	conn       *websocket.Conn
+	mu         sync.Mutex
+	conn       *wsConn // current connection
 	receive    chan []byte
 	Receive    <-chan []byte
 	disconnect chan error
 	Disconnect <-chan error
+	// RTMPing enables sending rtm ping message
+	RTMPing bool
+	// PingInterval is interval of rtm ping
+	PingInterval time.Duration
+	// PongTimeout is how long a pong reply is waited before closing connection
+	PongTimeout time.Duration
 }
 
 // NewWsClient create new WsClient
@@ -30,71 +49,272 @@ func NewWsClient() *WsClient {
 	receive := make(chan []byte, MsgChanBufSize)
 	disconnect := make(chan error)
 	return &WsClient{
-		receive:    receive,
-		Receive:    receive,
-		disconnect: disconnect,
-		Disconnect: disconnect,
+		receive:      receive,
+		Receive:      receive,
+		disconnect:   disconnect,
+		Disconnect:   disconnect,
+		RTMPing:      true,
+		PingInterval: pingInterval,
+		PongTimeout:  pongTimeout,
+	}
+}
+
+// wsWrite is a message written by writer goroutine
+type wsWrite struct {
+	data   []byte
+	result chan error
+}
+
+// wsConn is a websocket connection.
+// Messages are written only by its writer goroutine.
+type wsConn struct {
+	conn      *websocket.Conn
+	send      chan wsWrite
+	closing   chan struct{} // closed by close
+	closeOnce sync.Once
+	err       error // cause of close
+
+	mu       sync.Mutex
+	pingID   uint
+	pending  map[uint]time.Time // sent time of pings waiting pong
+	lastPong time.Time
+}
+
+func newWsConn(conn *websocket.Conn) *wsConn {
+	return &wsConn{
+		conn:     conn,
+		send:     make(chan wsWrite),
+		closing:  make(chan struct{}),
+		pending:  map[uint]time.Time{},
+		lastPong: time.Now(),
+	}
+}
+
+// close the connection once. err is reported as disconnect cause.
+func (wc *wsConn) close(err error) {
+	wc.closeOnce.Do(func() {
+		wc.err = err
+		close(wc.closing)
+		// Close can be called concurrently with writer
+		if err := wc.conn.Close(); err != nil {
+			logger.Debugf("%v", err)
+		}
+	})
+}
+
+// write a message through writer goroutine and wait for the result
+func (wc *wsConn) write(data []byte) error {
+	req := wsWrite{data: data, result: make(chan error, 1)}
+	select {
+	case wc.send <- req:
+	case <-wc.closing:
+		return errClosed
+	}
+	select {
+	case err := <-req.result:
+		return err
+	case <-wc.closing:
+		return errClosed
+	}
+}
+
+func (wc *wsConn) writeLoop() {
+	for {
+		select {
+		case req := <-wc.send:
+			if err := wc.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+				req.result <- err
+				continue
+			}
+			req.result <- wc.conn.WriteMessage(websocket.TextMessage, req.data)
+		case <-wc.closing:
+			return
+		}
+	}
+}
+
+// alive record the connection is alive
+func (wc *wsConn) alive() {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	wc.lastPong = time.Now()
+}
+
+// nextPing return new ping id, it waits for pong
+func (wc *wsConn) nextPing() uint {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	wc.pingID++
+	wc.pending[wc.pingID] = time.Now()
+	return wc.pingID
+}
+
+// handlePong tests the message is pong, and record it if it replies a ping of this connection
+func (wc *wsConn) handlePong(msg []byte) bool {
+	p := pong{}
+	if err := json.Unmarshal(msg, &p); err != nil || p.Type != "pong" {
+		return false
 	}
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	if _, ok := wc.pending[p.ReplyTo]; ok {
+		delete(wc.pending, p.ReplyTo)
+		wc.lastPong = time.Now()
+	}
+	return true
+}
+
+// pongOverdue tests a ping has waited pong longer than timeout
+func (wc *wsConn) pongOverdue(timeout time.Duration) bool {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	for _, sent := range wc.pending {
+		if time.Since(sent) > timeout {
+			return true
+		}
+	}
+	return false
 }
 
-// Connect to slack websocket api and start read loop
-func (c *WsClient) Connect(url string) error {
+// Connect to slack websocket api and start read loop.
+// The connection is closed when ctx is done. Previous connection is closed silently.
+func (c *WsClient) Connect(ctx context.Context, url string) error {
 	dialer := websocket.DefaultDialer
-	conn, _, err := dialer.Dial(url, nil)
+	conn, _, err := dialer.DialContext(ctx, url, nil)
 	if err != nil {
 		return err
 	}
-	c.conn = conn
-	go c.readLoop()
-	go c.pinger()
+	wc := newWsConn(conn)
+	// websocket ping frames also keep read loop alive
+	conn.SetPingHandler(func(data string) error {
+		wc.alive()
+		if err := conn.SetReadDeadline(time.Now().Add(ReadTimeout)); err != nil {
+			return err
+		}
+		// WriteControl can be called concurrently with writer
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeTimeout))
+	})
+
+	c.mu.Lock()
+	prev := c.conn
+	c.conn = wc
+	c.mu.Unlock()
+	if prev != nil {
+		prev.close(errClosed)
+	}
+
+	go wc.writeLoop()
+	go c.readLoop(ctx, wc)
+	go c.keepAlive(ctx, wc)
 	return nil
 }
 
-// Close websocket connection
-func (c *WsClient) Close() {
-	err := c.conn.Close()
-	c.conn = nil
+// current return current connection
+func (c *WsClient) current() *wsConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// Send a message as json
+func (c *WsClient) Send(v interface{}) error {
+	jsonBytes, err := json.Marshal(v)
 	if err != nil {
-		logger.Warnf("%v", err)
+		return err
+	}
+	wc := c.current()
+	if wc == nil {
+		return errNotConnected
+	}
+	return wc.write(jsonBytes)
+}
+
+// LastPong return when the current connection is confirmed alive by pong or ping frame.
+// It's zero while disconnected.
+func (c *WsClient) LastPong() time.Time {
+	wc := c.current()
+	if wc == nil {
+		return time.Time{}
 	}
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	return wc.lastPong
 }
 
-func (c *WsClient) pinger() {
-	var seqNo uint = 1
-	ticker := time.NewTicker(pingInterval)
-	msg := ping{Type: "ping"}
-	defer ticker.Stop()
+// Close websocket connection.
+// Read loop reports disconnect after closed. It's safe to call twice.
+func (c *WsClient) Close() {
+	if wc := c.current(); wc != nil {
+		wc.close(errClosed)
+	}
+}
+
+// keepAlive send rtm ping if RTMPing is enabled, and close the connection if pong is overdue.
+// It closes the connection when ctx is done.
+func (c *WsClient) keepAlive(ctx context.Context, wc *wsConn) {
+	var tick <-chan time.Time
+	if c.RTMPing {
+		ticker := time.NewTicker(c.PingInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 	for {
 		select {
-		case <-ticker.C:
-			msg.ID = seqNo
-			jsonBytes, err := json.Marshal(msg)
+		case <-ctx.Done():
+			wc.close(ctx.Err())
+			return
+		case <-wc.closing:
+			return
+		case <-tick:
+			if wc.pongOverdue(c.PongTimeout) {
+				wc.close(errPongTimeout)
+				return
+			}
+			jsonBytes, err := json.Marshal(ping{ID: wc.nextPing(), Type: "ping"})
 			if err != nil {
-				logger.Warnf("ping message error: %v", err)
+				logger.Warnf("%v", err)
 				continue
 			}
 			logger.Debug("send ping")
-			if err := c.conn.WriteMessage(websocket.TextMessage, jsonBytes); err != nil {
+			if err := wc.write(jsonBytes); err != nil {
 				logger.Warnf("ping send error: %v", err)
-				continue
 			}
-			seqNo = seqNo + 1
 		}
 	}
 }
 
-func (c *WsClient) readLoop() {
+func (c *WsClient) readLoop(ctx context.Context, wc *wsConn) {
 	for {
-		err := c.conn.SetReadDeadline(time.Now().Add(ReadTimeout))
+		err := wc.conn.SetReadDeadline(time.Now().Add(ReadTimeout))
 		if err != nil {
 			logger.Warnf("%v", err)
 		}
-		_, msg, err := c.conn.ReadMessage()
+		_, msg, err := wc.conn.ReadMessage()
 		if err != nil {
-			c.Close()
-			c.disconnect <- err
-			return
+			wc.close(err)
+			break
+		}
+		if wc.handlePong(msg) {
+			continue
+		}
+		select {
+		case c.receive <- msg:
+		case <-wc.closing:
 		}
-		c.receive <- msg
+	}
+
+	// disconnect is reported only for current connection
+	c.mu.Lock()
+	current := c.conn == wc
+	if current {
+		c.conn = nil
+	}
+	c.mu.Unlock()
+	if !current {
+		return
+	}
+	select {
+	case c.disconnect <- wc.err:
+	case <-ctx.Done():
 	}
 }
@@ -0,0 +1,187 @@
+package haven
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestWsServer start websocket server. handle is called with each received message,
+// and returned messages are sent back.
+func newTestWsServer(handle func(msg []byte) [][]byte) (string, func()) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			for _, reply := range handle(msg) {
+				if err := conn.WriteMessage(websocket.TextMessage, reply); err != nil {
+					return
+				}
+			}
+		}
+	}))
+	return "ws" + strings.TrimPrefix(server.URL, "http"), server.Close
+}
+
+// rtmPongServer replies pong to ping and echoes other messages
+func rtmPongServer(msg []byte) [][]byte {
+	p := ping{}
+	if err := json.Unmarshal(msg, &p); err == nil && p.Type == "ping" {
+		reply, _ := json.Marshal(pong{Type: "pong", ReplyTo: p.ID})
+		return [][]byte{reply}
+	}
+	return [][]byte{msg}
+}
+
+func TestWsClientSendReceive(t *testing.T) {
+	url, closer := newTestWsServer(rtmPongServer)
+	defer closer()
+
+	c := NewWsClient()
+	if err := c.Send(ping{ID: 1, Type: "hello"}); err != errNotConnected {
+		t.Errorf("Expected not connected error. Actual: %v", err)
+	}
+	if err := c.Connect(context.Background(), url); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent sends are serialized by writer
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := c.Send(ping{ID: uint(i), Type: "hello"}); err != nil {
+				t.Errorf("Send failed. %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	received := map[uint]bool{}
+	for i := 0; i < 10; i++ {
+		select {
+		case msg := <-c.Receive:
+			p := ping{}
+			json.Unmarshal(msg, &p)
+			received[p.ID] = true
+		case <-time.After(time.Second):
+			t.Fatal("Echo is not received")
+		}
+	}
+	if len(received) != 10 {
+		t.Errorf("Expected 10 messages. Actual: %v", received)
+	}
+
+	c.Close()
+	c.Close()
+	select {
+	case err := <-c.Disconnect:
+		if err != errClosed {
+			t.Errorf("Expected closed error. Actual: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect is not reported")
+	}
+	if !c.LastPong().IsZero() {
+		t.Error("Expected last pong is zero after disconnect")
+	}
+}
+
+func TestWsClientPong(t *testing.T) {
+	url, closer := newTestWsServer(rtmPongServer)
+	defer closer()
+
+	c := NewWsClient()
+	c.PingInterval = time.Millisecond * 10
+	c.PongTimeout = time.Millisecond * 100
+	if err := c.Connect(context.Background(), url); err != nil {
+		t.Fatal(err)
+	}
+	connected := c.LastPong()
+	time.Sleep(time.Millisecond * 100)
+
+	if !c.LastPong().After(connected) {
+		t.Error("Expected pong is recorded")
+	}
+	select {
+	case msg := <-c.Receive:
+		t.Errorf("Expected pong is not forwarded. Actual: %s", msg)
+	case err := <-c.Disconnect:
+		t.Errorf("Unexpected disconnect %v", err)
+	default:
+	}
+	c.Close()
+	<-c.Disconnect
+}
+
+func TestWsClientPongTimeout(t *testing.T) {
+	// server never replies
+	url, closer := newTestWsServer(func(msg []byte) [][]byte { return nil })
+	defer closer()
+
+	c := NewWsClient()
+	c.PingInterval = time.Millisecond * 10
+	c.PongTimeout = time.Millisecond * 15
+	if err := c.Connect(context.Background(), url); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-c.Disconnect:
+		if err != errPongTimeout {
+			t.Errorf("Expected pong timeout. Actual: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect is not reported")
+	}
+}
+
+func TestWsClientLifecycle(t *testing.T) {
+	url, closer := newTestWsServer(rtmPongServer)
+	defer closer()
+
+	c := NewWsClient()
+	c.RTMPing = false
+	if err := c.Connect(context.Background(), url); err != nil {
+		t.Fatal(err)
+	}
+	// reconnecting closes previous connection silently
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := c.Connect(ctx, url); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(ping{ID: 1, Type: "hello"}); err != nil {
+		t.Errorf("Send failed. %v", err)
+	}
+	select {
+	case <-c.Receive:
+	case err := <-c.Disconnect:
+		t.Fatalf("Unexpected disconnect %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("Echo is not received")
+	}
+
+	// canceling context closes the connection
+	cancel()
+	for i := 0; i < 100 && c.current() != nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if c.current() != nil {
+		t.Error("Expected connection is closed by context")
+	}
+}
@@ -1,15 +1,22 @@
 package haven
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
 	"reflect"
+	"sort"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 var ch1 = channel{ID: "1", Members: []string{"A", "B", "C"}}
 var ch2 = channel{ID: "2", Members: []string{"A", "D", "E"}}
 
 func TestRelayGroup(t *testing.T) {
-	r := relayGroup{ch1.ID: ch1, ch2.ID: ch2}
+	r := relayGroup{ch1.ID: {channel: ch1}, ch2.ID: {channel: ch2}}
 	if !r.hasChannel("1") {
 		t.Error("Channel 1 not found")
 	}
@@ -28,10 +35,10 @@ func TestRelayGroup(t *testing.T) {
 }
 
 func TestRelayGroups(t *testing.T) {
-	cfg := Config{RelayRooms: map[string]struct{}{"1": {}, "2": {}}}
+	rooms := map[string]RelayDirection{"1": Bidirectional, "2": Bidirectional}
 
 	chans := []channel{ch1, ch2}
-	group := newRelayGroup(&cfg, chans)
+	group := newRelayGroup(rooms, chans)
 
 	if group.channelCount() != 2 {
 		t.Errorf("Expected channel count is 2. Actual: %v", group.channelCount())
@@ -62,3 +69,379 @@ func TestRelayGroups(t *testing.T) {
 	//	t.Errorf("Expected channel id is nil. Actual: %v", d)
 	//}
 }
+
+var ch3 = channel{ID: "3", Members: []string{"F"}}
+var ch4 = channel{ID: "4", Members: []string{"G"}}
+
+func TestMultipleRelayGroups(t *testing.T) {
+	cfg := Config{RelayGroups: map[string]map[string]RelayDirection{
+		"a": {"1": Bidirectional, "2": Bidirectional},
+		"b": {"1": Bidirectional, "3": Bidirectional},
+		"c": {"4": Bidirectional, "5": Bidirectional},
+	}}
+
+	groups := newRelayGroups(&cfg, []channel{ch1, ch2, ch3, ch4})
+
+	d := groups.determineRelayChannels(ch1.ID)
+	if !reflect.DeepEqual(d, []string{ch2.ID, ch3.ID}) {
+		t.Errorf("Expected channel ids are [%v %v]. Actual: %v", ch2.ID, ch3.ID, d)
+	}
+
+	d = groups.determineRelayChannels(ch2.ID)
+	if !reflect.DeepEqual(d, []string{ch1.ID}) {
+		t.Errorf("Expected channel ids are [%v]. Actual: %v", ch1.ID, d)
+	}
+
+	// channel 5 is not visible, so group c has no peer
+	d = groups.determineRelayChannels(ch4.ID)
+	if d != nil {
+		t.Errorf("Expected channel id is nil. Actual: %v", d)
+	}
+
+	if names := groups.groupsOf(ch3.ID).names(); !reflect.DeepEqual(names, []string{"b"}) {
+		t.Errorf("Expected group names are [b]. Actual: %v", names)
+	}
+
+	if groups.hasUser("X") {
+		t.Error("Groups don't have user X but found him")
+	}
+}
+
+func TestDirectionalRelayGroup(t *testing.T) {
+	rooms := map[string]RelayDirection{"1": SendOnly, "2": ReceiveOnly, "3": ReceiveOnly, "4": Bidirectional}
+	group := newRelayGroup(rooms, []channel{ch1, ch2, ch3, ch4})
+
+	d := group.determineRelayChannels(ch1.ID)
+	sort.Strings(d)
+	if !reflect.DeepEqual(d, []string{ch2.ID, ch3.ID, ch4.ID}) {
+		t.Errorf("Expected channel ids are [2 3 4]. Actual: %v", d)
+	}
+
+	d = group.determineRelayChannels(ch2.ID)
+	if d != nil {
+		t.Errorf("Receive only channel must not relay. Actual: %v", d)
+	}
+
+	d = group.determineRelayChannels(ch4.ID)
+	sort.Strings(d)
+	if !reflect.DeepEqual(d, []string{ch2.ID, ch3.ID}) {
+		t.Errorf("Expected channel ids are [2 3]. Actual: %v", d)
+	}
+
+	d = group.determineRelayChannelsMulti([]string{ch2.ID, ch3.ID})
+	if d != nil {
+		t.Errorf("Receive only channels must not relay. Actual: %v", d)
+	}
+}
+
+func TestParseRelayRoom(t *testing.T) {
+	id, dir, err := ParseRelayRoom("C1:receive-only")
+	if err != nil || id != "C1" || dir != ReceiveOnly {
+		t.Errorf("Parse failed. id: %v, dir: %v, err: %v", id, dir, err)
+	}
+
+	id, dir, err = ParseRelayRoom("C2")
+	if err != nil || id != "C2" || dir != Bidirectional {
+		t.Errorf("Parse failed. id: %v, dir: %v, err: %v", id, dir, err)
+	}
+
+	if _, _, err = ParseRelayRoom("C3:both"); err == nil {
+		t.Error("Expected error for unknown direction")
+	}
+}
+
+func TestThreadOrigin(t *testing.T) {
+	b := &RelayBot{messageLog: newMessageLog(newMemoryMessageStore(10))}
+	b.messageLog.add("1", "a", "a")
+	b.messageLog.add("2", "b", "a")
+
+	reply := &message{Channel: "2", Ts: "c", ThreadTs: "b"}
+	if origin := b.threadOrigin(reply); origin != "a" {
+		t.Errorf("Expected thread origin a. Actual: %v", origin)
+	}
+
+	parent := &message{Channel: "1", Ts: "a", ThreadTs: "a"}
+	if origin := b.threadOrigin(parent); origin != "" {
+		t.Errorf("Thread parent is not a reply. Actual: %v", origin)
+	}
+
+	unknown := &message{Channel: "1", Ts: "d", ThreadTs: "x"}
+	if origin := b.threadOrigin(unknown); origin != "" {
+		t.Errorf("Expected unknown parent is empty. Actual: %v", origin)
+	}
+}
+
+func TestRelayGroupsMembership(t *testing.T) {
+	cfg := Config{RelayGroups: map[string]map[string]RelayDirection{
+		"a": {"1": Bidirectional, "2": Bidirectional, "3": ReceiveOnly},
+	}}
+	groups := newRelayGroups(&cfg, []channel{
+		{ID: "1", Members: []string{"A", "C"}},
+		{ID: "2", Members: []string{"D"}},
+	})
+
+	groups.addMember("1", "B")
+	groups.addMember("1", "B")
+	if m := groups["a"]["1"].Members; !reflect.DeepEqual(m, []string{"A", "B", "C"}) {
+		t.Errorf("Expected members [A B C]. Actual: %v", m)
+	}
+
+	groups.removeMember("1", "A")
+	if m := groups["a"]["1"].Members; !reflect.DeepEqual(m, []string{"B", "C"}) {
+		t.Errorf("Expected members [B C]. Actual: %v", m)
+	}
+	if groups.hasUser("A") {
+		t.Error("Removed user A found")
+	}
+
+	groups.addChannel(&cfg, channel{ID: "3", Members: []string{"E"}})
+	if !groups.hasUser("E") || groups["a"]["3"].direction != ReceiveOnly {
+		t.Errorf("Channel 3 is not added. Actual: %v", groups)
+	}
+
+	groups.addChannel(&cfg, channel{ID: "9"})
+	if groups.hasChannel("9") {
+		t.Error("Not configured channel is added")
+	}
+
+	groups.removeChannel("2")
+	if d := groups.determineRelayChannels("1"); !reflect.DeepEqual(d, []string{"3"}) {
+		t.Errorf("Expected channel ids [3]. Actual: %v", d)
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	sec := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	mu := sync.Mutex{}
+	posted := []postMessageRequest{}
+	api, _, closer := newTestAPIClient(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/conversations.history":
+			if r.URL.Query().Get("channel") != "1" || r.URL.Query().Get("oldest") != sec+".000000" {
+				t.Errorf("Unexpected history request %v", r.URL.Query())
+			}
+			w.Write([]byte(`{"ok": true, "messages": [
+				{"type": "message", "user": "A", "text": "haven, what's the status of the PR?", "ts": "` + sec + `.000005"},
+				{"type": "message", "user": "A", "text": "haven status", "ts": "` + sec + `.000004"},
+				{"type": "message", "subtype": "bot_message", "text": "relayed", "ts": "` + sec + `.000003"},
+				{"type": "message", "user": "A", "text": "second", "ts": "` + sec + `.000002"},
+				{"type": "message", "user": "A", "text": "first", "ts": "` + sec + `.000001"}]}`))
+		case "/users.info":
+			w.Write([]byte(`{"ok": true, "user": {"id": "A", "name": "alice"}}`))
+		case "/chat.postMessage":
+			pm := postMessageRequest{}
+			json.NewDecoder(r.Body).Decode(&pm)
+			mu.Lock()
+			posted = append(posted, pm)
+			mu.Unlock()
+			w.Write([]byte(`{"ok": true, "ts": "200.000001"}`))
+		default:
+			t.Errorf("Unexpected api call %v", r.URL.Path)
+		}
+	})
+	defer closer()
+
+	cfg := &Config{RelayGroups: map[string]map[string]RelayDirection{
+		"a": {"1": Bidirectional, "2": Bidirectional},
+	}}
+	outbox, _, _ := openOutbox("")
+	lastSeen, _ := openLastSeen("")
+	lastSeen.update("1", sec+".000000")
+	b := &RelayBot{
+		config:      cfg,
+		messageLog:  newMessageLog(newMemoryMessageStore(DefaultMessageLogSize)),
+		relayGroups: newRelayGroups(cfg, []channel{{ID: "1"}, {ID: "2"}}),
+		users:       newUserCache(api.fetchUserInfo),
+		api:         api,
+		delivery:    newDeliverer(DeliveryQueueSize),
+		outbox:      outbox,
+		lastSeen:    lastSeen,
+		missed:      make(chan *missedMessages),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// history is fetched without blocking, and relayed in event loop
+	b.catchUp(ctx)
+	select {
+	case m := <-b.missed:
+		b.relayMissed(m)
+	case <-time.After(time.Second):
+		t.Fatal("Missed messages are not fetched")
+	}
+	// caught up messages are never relayed twice
+	b.handleMessage(&message{Channel: "1", User: "A", Text: "second", Ts: sec + ".000002"})
+	waitDelivered(b.delivery, 3)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posted) != 3 || posted[0].Text != "first" || posted[1].Text != "second" {
+		t.Fatalf("Expected missed messages are relayed in order. Actual: %+v", posted)
+	}
+	// "haven status" is a command, but "haven," is just a word
+	if posted[2].Text != "haven, what's the status of the PR?" {
+		t.Errorf("Expected missed message starting with haven is relayed. Actual: %+v", posted[2])
+	}
+	if posted[0].Channel != "2" || posted[0].UserName != "alice"+DelayedSuffix {
+		t.Errorf("Expected delayed message to 2. Actual: %+v", posted[0])
+	}
+	if ts := lastSeen.get("1"); ts != sec+".000005" {
+		t.Errorf("Expected last seen is updated. Actual: %v", ts)
+	}
+	if ts := lastSeen.get("2"); ts == "" {
+		t.Error("Expected last seen of new channel is initialized")
+	}
+}
+
+func TestRelayMessageReplayedInThread(t *testing.T) {
+	api, _, closer := newTestAPIClient(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/conversations.replies":
+			if r.URL.Query().Get("channel") != "2" || r.URL.Query().Get("ts") != "200.000001" {
+				t.Errorf("Unexpected replies request %v", r.URL.Query())
+			}
+			w.Write([]byte(`{"ok": true, "messages": [
+				{"type": "message", "subtype": "bot_message", "text": "parent", "ts": "200.000001"},
+				{"type": "message", "subtype": "bot_message", "text": "reply", "ts": "200.000002", "thread_ts": "200.000001",
+				 "metadata": {"event_type": "haven_relay", "event_payload": {"origin": "100.000002"}}}]}`))
+		default:
+			// thread replies aren't in history, and posting again makes a duplicate
+			t.Errorf("Unexpected api call %v", r.URL.Path)
+			w.Write([]byte(`{"ok": false, "error": "unexpected"}`))
+		}
+	})
+	defer closer()
+
+	outbox, _, _ := openOutbox("")
+	b := &RelayBot{
+		config:     &Config{},
+		messageLog: newMessageLog(newMemoryMessageStore(DefaultMessageLogSize)),
+		api:        api,
+		outbox:     outbox,
+	}
+	b.messageLog.add("1", "100.000001", "100.000001")
+	b.messageLog.add("2", "200.000001", "100.000001")
+	b.messageLog.add("1", "100.000002", "100.000002")
+	e := &outboxEntry{
+		Kind:         outboxPost,
+		Channel:      "2",
+		OriginID:     "100.000002",
+		Time:         time.Now().Unix(),
+		ThreadOrigin: "100.000001",
+		Post:         &postMessageRequest{Text: "reply"},
+		Started:      true,
+	}
+	if err := b.relayMessage(e); err != nil {
+		t.Fatal(err)
+	}
+	if origin := b.messageLog.originOf("2", "200.000002"); origin != "100.000002" {
+		t.Errorf("Expected relayed reply is found in thread. Actual: %q", origin)
+	}
+}
+
+// fakeTransport never connects until ctx is done
+type fakeTransport struct {
+	events chan []byte
+	lost   chan error
+	closed bool
+	alive  time.Time
+}
+
+func (t *fakeTransport) connect(ctx context.Context) (*self, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (t *fakeTransport) receive() <-chan []byte {
+	return t.events
+}
+
+func (t *fakeTransport) disconnect() <-chan error {
+	return t.lost
+}
+
+func (t *fakeTransport) lastAlive() time.Time {
+	return t.alive
+}
+
+func (t *fakeTransport) close() {
+	t.closed = true
+}
+
+func TestStartCanceled(t *testing.T) {
+	outbox, _, _ := openOutbox("")
+	transport := &fakeTransport{}
+	b := &RelayBot{
+		config:     &Config{},
+		transport:  transport,
+		messageLog: newMessageLog(newMemoryMessageStore(DefaultMessageLogSize)),
+		delivery:   newDeliverer(DeliveryQueueSize),
+		outbox:     outbox,
+		conn:       newConnectionTracker(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		cancel()
+	}()
+	if err := b.Start(ctx); err != context.Canceled {
+		t.Errorf("Expected canceled. Actual: %v", err)
+	}
+	if !transport.closed || b.ConnectionStatus().State != StateStopped {
+		t.Errorf("Expected bot is shut down. %+v", b.ConnectionStatus())
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	api, _, closer := newTestAPIClient(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("channel") {
+		case "3":
+			w.Write([]byte(`{"ok": true, "members": ["C"]}`))
+		default:
+			w.Write([]byte(`{"ok": true, "members": ["A"]}`))
+		}
+	})
+	defer closer()
+
+	cfg := &Config{
+		Token:       "token",
+		RelayGroups: map[string]map[string]RelayDirection{"a": {"1": Bidirectional, "2": Bidirectional}},
+	}
+	state, _ := openRelayState("")
+	b := &RelayBot{
+		config:      cfg,
+		relayGroups: newRelayGroups(cfg, []channel{{ID: "1"}, {ID: "2"}}),
+		api:         api,
+		state:       state,
+		reloads:     make(chan *Config, 1),
+	}
+
+	// pending config is replaced by newer one
+	b.Reload(&Config{Token: "token"})
+	b.Reload(&Config{
+		Token:        "other",
+		RelayGroups:  map[string]map[string]RelayDirection{"b": {"1": Bidirectional, "3": ReceiveOnly}},
+		DeleteOrigin: true,
+	})
+	b.applyConfig(<-b.reloads)
+	select {
+	case c := <-b.reloads:
+		t.Errorf("Expected older config is dropped. Actual: %+v", c)
+	default:
+	}
+
+	if b.relayGroups.hasChannel("2") || !b.relayGroups.hasChannel("3") {
+		t.Errorf("Expected relay groups are swapped. Actual: %v", b.relayGroups)
+	}
+	if d := b.relayGroups.determineRelayChannels("1"); !reflect.DeepEqual(d, []string{"3"}) {
+		t.Errorf("Expected channel ids [3]. Actual: %v", d)
+	}
+	if !b.relayGroups.hasUser("C") {
+		t.Error("Expected members of new channel are fetched")
+	}
+	if !b.config.DeleteOrigin || b.config.Token != "token" {
+		t.Errorf("Expected only relay groups and delete-origin are reloaded. Actual: %+v", b.config)
+	}
+	if cfg.DeleteOrigin {
+		t.Error("Expected previous config is not modified")
+	}
+}
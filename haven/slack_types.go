@@ -2,23 +2,78 @@ package haven
 
 import (
 	"encoding/json"
-	"errors"
 )
 
-type rtmStartRequest struct {
-	SimpleLatest bool `json:"simple_latest"`
-	NoUnreads    bool `json:"no_unreads"`
+type rtmConnectResponse struct {
+	Ok    bool   `json:"ok"`
+	URL   string `json:"url"`
+	Self  self   `json:"self"`
+	Error string `json:"error"`
+	Team  struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Domain string `json:"domain"`
+	} `json:"team"`
+}
+
+type authTestResponse struct {
+	Ok     bool   `json:"ok"`
+	Error  string `json:"error"`
+	UserID string `json:"user_id"`
+	User   string `json:"user"`
+	TeamID string `json:"team_id"`
+	BotID  string `json:"bot_id"`
+}
+
+type connectionsOpenResponse struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+	URL   string `json:"url"`
+}
+
+// socketModeEnvelope wraps payload sent through socket mode
+type socketModeEnvelope struct {
+	EnvelopeID string          `json:"envelope_id"`
+	Type       string          `json:"type"`
+	Reason     string          `json:"reason"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+type socketModeAck struct {
+	EnvelopeID string `json:"envelope_id"`
+}
+
+// eventCallback wraps event sent through events api and socket mode
+type eventCallback struct {
+	Type      string          `json:"type"`
+	Challenge string          `json:"challenge"`
+	EventID   string          `json:"event_id"`
+	Event     json.RawMessage `json:"event"`
+}
+
+type responseMetadata struct {
+	NextCursor string `json:"next_cursor"`
+}
+
+type conversationHistoryResponse struct {
+	Ok               bool             `json:"ok"`
+	Error            string           `json:"error"`
+	Messages         []message        `json:"messages"`
+	HasMore          bool             `json:"has_more"`
+	ResponseMetadata responseMetadata `json:"response_metadata"`
+}
+
+type conversationMembersResponse struct {
+	Ok               bool             `json:"ok"`
+	Error            string           `json:"error"`
+	Members          []string         `json:"members"`
+	ResponseMetadata responseMetadata `json:"response_metadata"`
 }
 
-type rtmStartResponse struct {
-	Ok       bool      `json:"ok"`
-	URL      string    `json:"url"`
-	Self     self      `json:"self"`
-	Error    string    `json:"error"`
-	Users    []user    `json:"users"`
-	Channels []channel `json:"channels"`
-	Mpims    []mpim    `json:"mpims"`
-	Groups   []channel `json:"groups"`
+type userInfoResponse struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+	User  user   `json:"user"`
 }
 
 type self struct {
@@ -65,20 +120,6 @@ func (p profile) FullName() string {
 	return "名無し@すらっくへいぶん"
 }
 
-type mpim struct {
-	ID                 string   `json:"id"`
-	Name               string   `json:"name"`
-	IsMpim             bool     `json:"is_mpim"`
-	IsGroup            bool     `json:"is_group"`
-	Created            int      `json:"created"`
-	Creator            string   `json:"creator"`
-	Members            []string `json:"members"`
-	LastRead           string   `json:"last_read"`
-	Latest             string   `json:"latest"`
-	UnreadCount        int      `json:"unread_count"`
-	UnreadCountDisplay int      `json:"unread_count_display"`
-}
-
 type channel struct {
 	ID         string   `json:"id"`
 	Name       string   `json:"name"`
@@ -111,6 +152,12 @@ type hello struct {
 	eventType
 }
 
+// reconnectURL is rtm event of url to reconnect
+type reconnectURL struct {
+	eventType
+	URL string `json:"url"`
+}
+
 type message struct {
 	eventType
 	ReplyTo     json.Number   `json:"reply_to,omitempty"`
@@ -118,9 +165,20 @@ type message struct {
 	User        string        `json:"user"`
 	Text        string        `json:"text"`
 	Ts          string        `json:"ts"`
+	ThreadTs    string        `json:"thread_ts,omitempty"`
 	Team        string        `json:"team"`
 	Attachments []attachment  `json:"attachments"`
 	Edited      messageEdited `json:"edited"`
+	// Metadata is attached to messages relayed by this bot
+	Metadata *messageMetadata `json:"metadata,omitempty"`
+	// Files is shared files, returned by history api
+	Files []slackFile `json:"files,omitempty"`
+}
+
+// isThreadReply tests the message is a reply in a thread.
+// Thread parent message also has thread_ts which equals ts.
+func (m message) isThreadReply() bool {
+	return m.ThreadTs != "" && m.ThreadTs != m.Ts
 }
 
 type messageEdited struct {
@@ -168,6 +226,33 @@ type postMessageRequest struct {
 	IconURL     string       `json:"icon_url,omitempty"`
 	IconEmoji   string       `json:"icon_emoji,omitempty"`
 	Attachments []attachment `json:"attachments,omitempty"`
+	// ThreadTs is parent message ts to post as a thread reply
+	ThreadTs       string           `json:"thread_ts,omitempty"`
+	ReplyBroadcast bool             `json:"reply_broadcast,omitempty"`
+	Metadata       *messageMetadata `json:"metadata,omitempty"`
+}
+
+// postEphemeralRequest is chat.postEphemeral request. The message is shown only to User.
+type postEphemeralRequest struct {
+	Channel  string `json:"channel"`
+	User     string `json:"user"`
+	Text     string `json:"text"`
+	UserName string `json:"username,omitempty"`
+	ThreadTs string `json:"thread_ts,omitempty"`
+}
+
+// relayEventType is metadata event type of relayed messages
+const relayEventType = "haven_relay"
+
+// messageMetadata is slack message metadata.
+// Relayed copies have origin id in it, so they are found in history.
+type messageMetadata struct {
+	EventType    string        `json:"event_type"`
+	EventPayload relayMetadata `json:"event_payload"`
+}
+
+type relayMetadata struct {
+	Origin string `json:"origin"`
 }
 
 type postMessageResponse struct {
@@ -185,6 +270,19 @@ type messageChanged struct {
 	Message message `json:"message"`
 }
 
+type messageDeleted struct {
+	eventType
+	Hidden    bool   `json:"hidden"`
+	Channel   string `json:"channel"`
+	Ts        string `json:"ts"`
+	DeletedTs string `json:"deleted_ts"`
+}
+
+type messageDeleteRequest struct {
+	Channel string `json:"channel"`
+	Ts      string `json:"ts"`
+}
+
 type messageUpdateRequest struct {
 	Channel     string       `json:"channel"`
 	Text        string       `json:"text"`
@@ -200,13 +298,6 @@ type slackOk struct {
 	Error string `json:"error"`
 }
 
-func (o slackOk) NewError() error {
-	if o.Error != "" {
-		return errors.New(o.Error)
-	}
-	return errors.New("slack response has something worng")
-}
-
 type slackFile struct {
 	ID                 string   `json:"id"`
 	Created            int      `json:"created"`
@@ -273,6 +364,9 @@ type reactionAdded struct {
 	EventTs string `json:"event_ts"`
 }
 
+// reactionRemoved has same fields as reactionAdded
+type reactionRemoved reactionAdded
+
 type reactionAddRequest struct {
 	Name        string `json:"name"`
 	Channel     string `json:"channel"`
@@ -281,7 +375,44 @@ type reactionAddRequest struct {
 	Timestamp   string `json:"timestamp,omitempty"`
 }
 
+// reactionRemoveRequest has same fields as reactionAddRequest
+type reactionRemoveRequest reactionAddRequest
+
+// userChange is team_join and user_change event
+type userChange struct {
+	eventType
+	User user `json:"user"`
+}
+
+// memberChannelEvent is member_joined_channel and member_left_channel event
+type memberChannelEvent struct {
+	eventType
+	User        string `json:"user"`
+	Channel     string `json:"channel"`
+	ChannelType string `json:"channel_type"`
+	Team        string `json:"team"`
+	Inviter     string `json:"inviter"`
+}
+
+// channelJoined is channel_joined and group_joined event
+type channelJoined struct {
+	eventType
+	Channel channel `json:"channel"`
+}
+
+// channelLeft is channel_left and group_left event
+type channelLeft struct {
+	eventType
+	Channel string `json:"channel"`
+}
+
 type ping struct {
 	ID   uint   `json:"id"`
 	Type string `json:"type"`
 }
+
+// pong is reply of ping
+type pong struct {
+	Type    string `json:"type"`
+	ReplyTo uint   `json:"reply_to"`
+}
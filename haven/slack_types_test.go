@@ -50,3 +50,28 @@ func TestMessageUnmarshal(t *testing.T) {
 		t.Errorf("Message parsed error. %v\n", err)
 	}
 }
+
+var TestReactionRemoved = `
+{
+    "type": "reaction_removed",
+    "user": "U1",
+    "reaction": "thumbsup",
+    "item_user": "U2",
+    "item": {
+        "type": "message",
+        "channel": "C1",
+        "ts": "1360782400.498405"
+    },
+    "event_ts": "1360782804.083113"
+}
+`
+
+func TestReactionRemovedUnmarshal(t *testing.T) {
+	ev := &reactionRemoved{}
+	if err := json.Unmarshal([]byte(TestReactionRemoved), ev); err != nil {
+		t.Errorf("Reaction removed parsed error. %v\n", err)
+	}
+	if ev.Reaction != "thumbsup" || ev.Item.Channel != "C1" || ev.Item.Ts != "1360782400.498405" {
+		t.Errorf("Reaction removed parsed wrong. %+v\n", ev)
+	}
+}
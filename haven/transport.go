@@ -0,0 +1,148 @@
+package haven
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// TransportRTM receives events through rtm websocket api
+	TransportRTM = "rtm"
+	// TransportSocketMode receives events through socket mode websocket
+	TransportSocketMode = "socket-mode"
+	// TransportEventsAPI receives events through events api http request
+	TransportEventsAPI = "events-api"
+
+	// ReconnectURLTTL is how long reconnect url of rtm is used for reconnecting
+	ReconnectURLTTL = time.Second * 30
+)
+
+// transport delivers slack events to RelayBot.
+// Each event is delivered as raw json of the event itself, such as message or reaction_added.
+type transport interface {
+	// connect to slack and return bot user.
+	// Connection is closed when ctx is done.
+	connect(ctx context.Context) (*self, error)
+	// receive return channel of event json
+	receive() <-chan []byte
+	// disconnect return channel notified when connection is lost
+	disconnect() <-chan error
+	// lastAlive return when the connection is confirmed alive lastly. zero if disconnected.
+	lastAlive() time.Time
+	// close connection
+	close()
+}
+
+// newTransport create transport which config specifies
+func newTransport(config *Config, api *apiClient) (transport, error) {
+	switch config.Transport {
+	case "", TransportRTM:
+		return newRTMTransport(api), nil
+	case TransportSocketMode:
+		return newSocketModeTransport(api, newAPIClient(config.AppToken)), nil
+	case TransportEventsAPI:
+		return newEventsAPITransport(api, config.SigningSecret, config.EventsAddr), nil
+	}
+	return nil, fmt.Errorf("Unknown transport %q", config.Transport)
+}
+
+// rtmTransport receives events through rtm websocket api.
+// goodbye and reconnect_url events are handled here.
+type rtmTransport struct {
+	api    *apiClient
+	ws     *WsClient
+	events chan []byte
+
+	mu             sync.Mutex
+	bot            *self
+	reconnectURL   string
+	reconnectURLAt time.Time
+}
+
+func newRTMTransport(api *apiClient) *rtmTransport {
+	t := &rtmTransport{
+		api:    api,
+		ws:     NewWsClient(),
+		events: make(chan []byte, MsgChanBufSize),
+	}
+	go t.forwardLoop()
+	return t
+}
+
+func (t *rtmTransport) connect(ctx context.Context) (*self, error) {
+	if url, bot := t.takeReconnectURL(); url != "" {
+		logger.Info("Connect ws with reconnect url")
+		err := t.ws.Connect(ctx, url)
+		if err == nil {
+			return bot, nil
+		}
+		logger.Warnf("cant connect with reconnect url: %v", err)
+	}
+	logger.Info("Call connect api")
+	res, err := t.api.connectRTM()
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Connect ws")
+	if err := t.ws.Connect(ctx, res.URL); err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.bot = &res.Self
+	t.mu.Unlock()
+	return &res.Self, nil
+}
+
+// takeReconnectURL return fresh reconnect url once
+func (t *rtmTransport) takeReconnectURL() (string, *self) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	url := t.reconnectURL
+	t.reconnectURL = ""
+	if url == "" || t.bot == nil || time.Since(t.reconnectURLAt) > ReconnectURLTTL {
+		return "", nil
+	}
+	return url, t.bot
+}
+
+// forwardLoop handles connection events and forwards others
+func (t *rtmTransport) forwardLoop() {
+	for msg := range t.ws.Receive {
+		ev := reconnectURL{}
+		if err := json.Unmarshal(msg, &ev); err == nil {
+			switch ev.Type {
+			case "goodbye":
+				// server closes the connection soon, reconnect before it
+				logger.Info("goodbye received")
+				t.ws.Close()
+				continue
+			case "reconnect_url":
+				t.mu.Lock()
+				t.reconnectURL = ev.URL
+				t.reconnectURLAt = time.Now()
+				t.mu.Unlock()
+				continue
+			}
+		}
+		t.events <- msg
+	}
+}
+
+func (t *rtmTransport) receive() <-chan []byte {
+	return t.events
+}
+
+func (t *rtmTransport) disconnect() <-chan error {
+	return t.ws.Disconnect
+}
+
+func (t *rtmTransport) lastAlive() time.Time {
+	return t.ws.LastPong()
+}
+
+func (t *rtmTransport) close() {
+	t.ws.Close()
+}
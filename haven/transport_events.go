@@ -0,0 +1,188 @@
+package haven
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// EventsAPIPath is http path receiving events api request
+	EventsAPIPath = "/slack/events"
+
+	// signatureMaxAge is max age of signed request to prevent replay attack
+	signatureMaxAge = time.Minute * 5
+
+	// maxEventsBodySize limits request body read before signature verification
+	maxEventsBodySize = 1 << 20
+)
+
+// eventsAPITransport receives events through events api http request.
+// Requests are verified by signing secret.
+type eventsAPITransport struct {
+	api           *apiClient
+	signingSecret string
+	addr          string
+	server        *http.Server // nil while not listening
+	mu            sync.Mutex
+	events        chan []byte
+	lost          chan error
+	now           func() time.Time
+}
+
+func newEventsAPITransport(api *apiClient, signingSecret, addr string) *eventsAPITransport {
+	t := &eventsAPITransport{
+		api:           api,
+		signingSecret: signingSecret,
+		addr:          addr,
+		events:        make(chan []byte, MsgChanBufSize),
+		lost:          make(chan error),
+		now:           time.Now,
+	}
+	return t
+}
+
+// connect start http server. The server is stopped by close, not by ctx.
+func (t *eventsAPITransport) connect(ctx context.Context) (*self, error) {
+	logger.Info("Call auth test api")
+	bot, err := t.api.authTest()
+	if err != nil {
+		return nil, err
+	}
+	if err := t.listen(); err != nil {
+		return nil, err
+	}
+	return bot, nil
+}
+
+// listen start http server if not listening.
+// http server keeps running over reconnection.
+func (t *eventsAPITransport) listen() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.server != nil {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", t.addr)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Listen events api on %s", ln.Addr())
+	mux := http.NewServeMux()
+	mux.Handle(EventsAPIPath, t)
+	server := &http.Server{Handler: mux}
+	t.server = server
+	go func() {
+		err := server.Serve(ln)
+		if err == http.ErrServerClosed {
+			return
+		}
+		t.mu.Lock()
+		t.server = nil
+		t.mu.Unlock()
+		t.lost <- err
+	}()
+	return nil
+}
+
+// verifySignature verify slack request signature
+func (t *eventsAPITransport) verifySignature(header http.Header, body []byte) bool {
+	ts := header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := t.now().Sub(time.Unix(sec, 0))
+	if age > signatureMaxAge || age < -signatureMaxAge {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(t.signingSecret))
+	mac.Write([]byte("v0:" + ts + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature")))
+}
+
+// ServeHTTP handle events api request
+func (t *eventsAPITransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxEventsBodySize))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if !t.verifySignature(r.Header, body) {
+		logger.Warnf("events api signature mismatch from %s", r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	callback := eventCallback{}
+	if err := json.Unmarshal(body, &callback); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	switch callback.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(callback.Challenge))
+		return
+	case "event_callback":
+		if len(callback.Event) > 0 {
+			// ack before waiting for event loop, slack retries unless acked within 3 seconds
+			w.WriteHeader(http.StatusOK)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			t.events <- callback.Event
+			return
+		}
+	default:
+		logger.Debugf("unhandled events api request %v", string(body))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (t *eventsAPITransport) receive() <-chan []byte {
+	return t.events
+}
+
+func (t *eventsAPITransport) disconnect() <-chan error {
+	return t.lost
+}
+
+// lastAlive return now while listening, slack doesn't ping http server
+func (t *eventsAPITransport) lastAlive() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.server == nil {
+		return time.Time{}
+	}
+	return t.now()
+}
+
+func (t *eventsAPITransport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.server == nil {
+		return
+	}
+	if err := t.server.Close(); err != nil {
+		logger.Warnf("%v", err)
+	}
+	t.server = nil
+}
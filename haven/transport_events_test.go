@@ -0,0 +1,110 @@
+package haven
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signedEventsRequest(secret string, ts time.Time, body string) *http.Request {
+	sec := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + sec + ":" + body))
+	req := httptest.NewRequest("POST", EventsAPIPath, bytes.NewBufferString(body))
+	req.Header.Set("X-Slack-Request-Timestamp", sec)
+	req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return req
+}
+
+func TestEventsAPIVerification(t *testing.T) {
+	tr := newEventsAPITransport(newAPIClient("token"), "secret", ":0")
+	body := `{"type": "url_verification", "challenge": "abc"}`
+
+	w := httptest.NewRecorder()
+	tr.ServeHTTP(w, signedEventsRequest("secret", time.Now(), body))
+	if w.Code != http.StatusOK || w.Body.String() != "abc" {
+		t.Errorf("Expected challenge response. Actual: %v %v", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	tr.ServeHTTP(w, signedEventsRequest("wrong", time.Now(), body))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected wrong secret is rejected. Actual: %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	tr.ServeHTTP(w, signedEventsRequest("secret", time.Now().Add(-time.Hour), body))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected old request is rejected. Actual: %v", w.Code)
+	}
+}
+
+func TestEventsAPIEventCallback(t *testing.T) {
+	tr := newEventsAPITransport(newAPIClient("token"), "secret", ":0")
+	body := `{"type": "event_callback", "event_id": "E1", "event": {"type": "message", "channel": "C1", "text": "hi"}}`
+
+	w := httptest.NewRecorder()
+	tr.ServeHTTP(w, signedEventsRequest("secret", time.Now(), body))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected event is accepted. Actual: %v", w.Code)
+	}
+
+	select {
+	case ev := <-tr.receive():
+		expected := `{"type": "message", "channel": "C1", "text": "hi"}`
+		if string(ev) != expected {
+			t.Errorf("Expected unwrapped event %s. Actual: %s", expected, ev)
+		}
+	default:
+		t.Error("Event is not delivered")
+	}
+}
+
+func TestEventsAPIBodyLimit(t *testing.T) {
+	tr := newEventsAPITransport(newAPIClient("token"), "secret", ":0")
+	body := `{"type": "event_callback", "event": {"text": "` + strings.Repeat("a", maxEventsBodySize) + `"}}`
+
+	w := httptest.NewRecorder()
+	tr.ServeHTTP(w, signedEventsRequest("secret", time.Now(), body))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected too large body is rejected. Actual: %v", w.Code)
+	}
+}
+
+func TestEventsAPIAckBeforeEnqueue(t *testing.T) {
+	tr := newEventsAPITransport(newAPIClient("token"), "secret", ":0")
+	// event loop is busy
+	tr.events = make(chan []byte)
+	server := httptest.NewServer(tr)
+	defer server.Close()
+
+	body := `{"type": "event_callback", "event": {"type": "message", "text": "hi"}}`
+	req := signedEventsRequest("secret", time.Now(), body)
+	req.RequestURI = ""
+	req.URL, _ = req.URL.Parse(server.URL + EventsAPIPath)
+	client := http.Client{Timeout: time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Expected ack without waiting for event loop. Actual: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected event is acked. Actual: %v", resp.StatusCode)
+	}
+
+	select {
+	case ev := <-tr.receive():
+		if string(ev) != `{"type": "message", "text": "hi"}` {
+			t.Errorf("Unexpected event %s", ev)
+		}
+	case <-time.After(time.Second):
+		t.Error("Event is not delivered")
+	}
+}
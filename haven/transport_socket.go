@@ -0,0 +1,127 @@
+package haven
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// socketModeTransport receives events through socket mode websocket.
+// Envelopes are acknowledged and unwrapped.
+type socketModeTransport struct {
+	api    *apiClient
+	appAPI *apiClient // called with app level token
+	ws     *WsClient
+	events chan []byte
+	lost   chan error
+	// done is closed by close to stop unwrap loop
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSocketModeTransport(api, appAPI *apiClient) *socketModeTransport {
+	ws := NewWsClient()
+	// socket mode server sends websocket ping frames instead
+	ws.RTMPing = false
+	t := &socketModeTransport{
+		api:    api,
+		appAPI: appAPI,
+		ws:     ws,
+		events: make(chan []byte, MsgChanBufSize),
+		lost:   make(chan error),
+		done:   make(chan struct{}),
+	}
+	go t.unwrapLoop()
+	return t
+}
+
+func (t *socketModeTransport) connect(ctx context.Context) (*self, error) {
+	logger.Info("Call auth test api")
+	bot, err := t.api.authTest()
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Call connections open api")
+	url, err := t.appAPI.openConnection()
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Connect ws")
+	if err := t.ws.Connect(ctx, url); err != nil {
+		return nil, err
+	}
+	return bot, nil
+}
+
+// unwrapLoop acknowledges envelopes and forwards events until closed
+func (t *socketModeTransport) unwrapLoop() {
+	for {
+		select {
+		case msg := <-t.ws.Receive:
+			t.handleEnvelope(msg)
+		case err := <-t.ws.Disconnect:
+			select {
+			case t.lost <- err:
+			case <-t.done:
+				return
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *socketModeTransport) handleEnvelope(msg []byte) {
+	envelope := socketModeEnvelope{}
+	if err := json.Unmarshal(msg, &envelope); err != nil {
+		logger.Warnf("%v", err)
+		return
+	}
+
+	if envelope.EnvelopeID != "" {
+		if err := t.ws.Send(socketModeAck{EnvelopeID: envelope.EnvelopeID}); err != nil {
+			logger.Warnf("cant ack envelope: %v", err)
+		}
+	}
+
+	switch envelope.Type {
+	case "events_api":
+		callback := eventCallback{}
+		if err := json.Unmarshal(envelope.Payload, &callback); err != nil {
+			logger.Warnf("%v", err)
+			return
+		}
+		if len(callback.Event) > 0 {
+			select {
+			case t.events <- callback.Event:
+			case <-t.done:
+			}
+		}
+	case "disconnect":
+		// slack closes the connection soon, reconnect before it
+		logger.Infof("socket mode disconnect requested: %s", envelope.Reason)
+		t.ws.Close()
+	case "hello":
+		logger.Debugf("socket mode hello %v", string(msg))
+	default:
+		logger.Debugf("unhandled envelope %v", string(msg))
+	}
+}
+
+func (t *socketModeTransport) receive() <-chan []byte {
+	return t.events
+}
+
+func (t *socketModeTransport) disconnect() <-chan error {
+	return t.lost
+}
+
+func (t *socketModeTransport) lastAlive() time.Time {
+	return t.ws.LastPong()
+}
+
+func (t *socketModeTransport) close() {
+	t.closeOnce.Do(func() { close(t.done) })
+	t.ws.Close()
+}
@@ -0,0 +1,151 @@
+package haven
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestSocketModeServer serve socket mode websocket.
+// Each connection is sent envelopes of the next session, and received acks are sent to acks.
+func newTestSocketModeServer(sessions [][]string, acks chan<- string) (string, func()) {
+	upgrader := websocket.Upgrader{}
+	mu := sync.Mutex{}
+	connected := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		mu.Lock()
+		envelopes := []string{}
+		if connected < len(sessions) {
+			envelopes = sessions[connected]
+		}
+		connected++
+		mu.Unlock()
+		for _, envelope := range envelopes {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(envelope)); err != nil {
+				return
+			}
+		}
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			acks <- string(msg)
+		}
+	}))
+	return "ws" + strings.TrimPrefix(server.URL, "http"), server.Close
+}
+
+func newTestSocketModeTransport(t *testing.T, wsURL string) (*socketModeTransport, func()) {
+	api, _, closer := newTestAPIClient(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/auth.test":
+			w.Write([]byte(`{"ok": true, "user_id": "U1", "user": "havenbot"}`))
+		case "/apps.connections.open":
+			w.Write([]byte(`{"ok": true, "url": "` + wsURL + `"}`))
+		default:
+			t.Errorf("Unexpected api call %v", r.URL.Path)
+		}
+	})
+	return newSocketModeTransport(api, api), closer
+}
+
+func expectAck(t *testing.T, acks <-chan string, envelopeID string) {
+	select {
+	case ack := <-acks:
+		expected := `{"envelope_id":"` + envelopeID + `"}`
+		if ack != expected {
+			t.Errorf("Expected ack %s. Actual: %s", expected, ack)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Envelope %s is not acknowledged", envelopeID)
+	}
+}
+
+func expectEvent(t *testing.T, tr *socketModeTransport, expected string) {
+	select {
+	case ev := <-tr.receive():
+		if string(ev) != expected {
+			t.Errorf("Expected unwrapped event %s. Actual: %s", expected, ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Event is not delivered")
+	}
+}
+
+func TestSocketModeEnvelope(t *testing.T) {
+	acks := make(chan string, 10)
+	url, closer := newTestSocketModeServer([][]string{{
+		`{"type": "hello", "num_connections": 1}`,
+		`{"envelope_id": "E0", "type": "interactive", "payload": {}}`,
+		`{"envelope_id": "E1", "type": "events_api", "payload": {"type": "event_callback", "event_id": "Ev1", "event": {"type": "message", "channel": "C1", "text": "hi"}}}`,
+	}}, acks)
+	defer closer()
+	tr, apiCloser := newTestSocketModeTransport(t, url)
+	defer apiCloser()
+	defer tr.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot, err := tr.connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bot.ID != "U1" || bot.Name != "havenbot" {
+		t.Errorf("Expected bot user by auth test. Actual: %+v", bot)
+	}
+
+	// every envelope is acknowledged, but only events are delivered
+	expectAck(t, acks, "E0")
+	expectAck(t, acks, "E1")
+	expectEvent(t, tr, `{"type": "message", "channel": "C1", "text": "hi"}`)
+	select {
+	case ev := <-tr.receive():
+		t.Errorf("Unexpected event %s", ev)
+	default:
+	}
+}
+
+func TestSocketModeReconnect(t *testing.T) {
+	acks := make(chan string, 10)
+	url, closer := newTestSocketModeServer([][]string{
+		{`{"type": "disconnect", "reason": "refresh_requested"}`},
+		{`{"envelope_id": "E2", "type": "events_api", "payload": {"type": "event_callback", "event": {"type": "message", "text": "again"}}}`},
+	}, acks)
+	defer closer()
+	tr, apiCloser := newTestSocketModeTransport(t, url)
+	defer apiCloser()
+	defer tr.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := tr.connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// disconnect request closes the connection, and it's reported to reconnect
+	select {
+	case err := <-tr.disconnect():
+		if err != errClosed {
+			t.Errorf("Expected closed error. Actual: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect is not reported")
+	}
+
+	if _, err := tr.connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectAck(t, acks, "E2")
+	expectEvent(t, tr, `{"type": "message", "text": "again"}`)
+}
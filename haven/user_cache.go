@@ -0,0 +1,50 @@
+package haven
+
+import (
+	"sync"
+)
+
+// userCache keeps users fetched through users.info api
+type userCache struct {
+	users map[string]user
+	mu    sync.RWMutex
+	fetch func(userID string) (*user, error)
+}
+
+func newUserCache(fetch func(userID string) (*user, error)) *userCache {
+	return &userCache{
+		users: map[string]user{},
+		fetch: fetch,
+	}
+}
+
+// get return cached user, fetch it if not cached
+func (c *userCache) get(userID string) (user, error) {
+	c.mu.RLock()
+	u, ok := c.users[userID]
+	c.mu.RUnlock()
+	if ok {
+		return u, nil
+	}
+
+	fetched, err := c.fetch(userID)
+	if err != nil {
+		return user{}, err
+	}
+	c.set(*fetched)
+	return *fetched, nil
+}
+
+// set cache user
+func (c *userCache) set(u user) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[u.ID] = u
+}
+
+// reset drop all cached users
+func (c *userCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users = map[string]user{}
+}
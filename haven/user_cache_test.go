@@ -0,0 +1,37 @@
+package haven
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUserCache(t *testing.T) {
+	fetched := 0
+	c := newUserCache(func(userID string) (*user, error) {
+		fetched++
+		if userID == "X" {
+			return nil, errors.New("user_not_found")
+		}
+		return &user{ID: userID, Name: "name-" + userID}, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		u, err := c.get("A")
+		if err != nil || u.Name != "name-A" {
+			t.Errorf("Expected user A. Actual: %+v, %v", u, err)
+		}
+	}
+	if fetched != 1 {
+		t.Errorf("Expected user is fetched once. Actual: %v", fetched)
+	}
+
+	if _, err := c.get("X"); err == nil {
+		t.Error("Expected error for unknown user")
+	}
+
+	c.reset()
+	c.get("A")
+	if fetched != 3 {
+		t.Errorf("Expected user is fetched after reset. Actual: %v", fetched)
+	}
+}
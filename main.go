@@ -1,7 +1,7 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -9,6 +9,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/k-saka/lvlogger"
 	"github.com/k-saka/slack-haven/haven"
@@ -18,60 +19,296 @@ var version string // version number or build hash
 
 var logger *lvlogger.LvLogger // global logger
 
-// Parse channel command line argument
-func parseChannelsArg(arg *string) map[string]struct{} {
-	rooms := strings.Split(*arg, ",")
-	roomConf := make(map[string]struct{}, len(rooms))
-	for _, room := range rooms {
-		roomConf[room] = struct{}{}
+// Parse channel command line argument.
+// See haven.ParseRelayGroups for the format.
+func parseChannelsArg(arg *string) (map[string]map[string]haven.RelayDirection, error) {
+	return haven.ParseRelayGroups(*arg)
+}
+
+// setFlags return names of command line options given explicitly
+func setFlags() map[string]bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// configPath return config file path given by option or environment variable. Empty if not given.
+func configPath() string {
+	if *argConfig != "" {
+		return *argConfig
+	}
+	return os.Getenv(haven.EnvPrefix + "CONFIG")
+}
+
+// configWatchInterval return config file watch interval given by option or environment variable
+func configWatchInterval() (time.Duration, error) {
+	if setFlags()["config-watch"] {
+		return *argConfigWatch, nil
+	}
+	v := os.Getenv(haven.EnvPrefix + "CONFIG_WATCH")
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%sCONFIG_WATCH: %v", haven.EnvPrefix, err)
 	}
-	return roomConf
+	return d, nil
 }
 
 func configure(c *haven.Config) error {
-	// Try reading config file
-	if err := haven.ConfigLoadFromFile(c); err != nil {
+	// Config is merged in order of file, environment variables and command line options
+	if err := haven.ConfigLoadFromFile(c, configPath()); err != nil {
 		return err
 	}
 
-	// Overwrite config with command line options
-	if *argToken != "" {
+	if err := haven.ConfigLoadFromEnv(c); err != nil {
+		return err
+	}
+
+	// Overwrite config with command line options given explicitly, so false and 0 overwrite too
+	set := setFlags()
+	if set["token"] {
 		c.Token = *argToken
+		c.TokenFile = ""
+	}
+
+	if set["token-file"] {
+		c.TokenFile = *argTokenFile
+	}
+
+	if set["channel"] {
+		groups, err := parseChannelsArg(argChannels)
+		if err != nil {
+			return err
+		}
+		c.RelayGroups = groups
+	}
+
+	if set["message-log"] {
+		c.MessageLogPath = *argMessageLog
+	}
+
+	if set["message-retention"] {
+		c.MessageRetention = *argMessageRetention
+	}
+
+	if set["outbox"] {
+		c.OutboxPath = *argOutbox
+	}
+
+	if set["last-seen"] {
+		c.LastSeenPath = *argLastSeen
+	}
+
+	if set["reconnect-min-wait"] {
+		c.ReconnectMinWait = *argReconnectMinWait
+	}
+
+	if set["reconnect-max-wait"] {
+		c.ReconnectMaxWait = *argReconnectMaxWait
+	}
+
+	if set["reconnect-max-attempts"] {
+		c.ReconnectMaxAttempts = *argReconnectMaxAttempts
+	}
+
+	if set["shutdown-timeout"] {
+		c.ShutdownTimeout = *argShutdownTimeout
+	}
+
+	if set["control-channel"] {
+		c.ControlChannel = *argControlChannel
+	}
+
+	if set["state"] {
+		c.StatePath = *argState
+	}
+
+	if set["admin-users"] {
+		c.AdminUsers = nil
+		if *argAdminUsers != "" {
+			c.AdminUsers = strings.Split(*argAdminUsers, ",")
+		}
+	}
+
+	if set["workspace-admins"] {
+		c.WorkspaceAdmins = *argWorkspaceAdmins
+	}
+
+	if set["command-prefix"] {
+		c.CommandPrefix = *argCommandPrefix
+	}
+
+	if set["command-mention-only"] {
+		c.CommandMentionOnly = *argCommandMentionOnly
+	}
+
+	if set["public-replies"] {
+		c.PublicReplies = *argPublicReplies
+	}
+
+	if set["delete-origin"] {
+		c.DeleteOrigin = *argDeleteOrigin
+	}
+
+	if set["transport"] {
+		c.Transport = *argTransport
+	}
+
+	if set["app-token"] {
+		c.AppToken = *argAppToken
+	}
+
+	if set["signing-secret"] {
+		c.SigningSecret = *argSigningSecret
 	}
 
-	if *argChannels != "" {
-		c.RelayRooms = parseChannelsArg(argChannels)
+	if set["events-addr"] {
+		c.EventsAddr = *argEventsAddr
 	}
 
-	// Validate options
-	if c.Token == "" {
-		return errors.New("Token is empty")
+	if set["admin-addr"] {
+		c.AdminAddr = *argAdminAddr
 	}
 
-	if len(c.RelayRooms) < 2 {
-		return errors.New("Invalid room count")
+	if c.StatePath == "" {
+		// changes by admin commands are kept next to config file by default
+		path, err := haven.DefaultStatePath(configPath())
+		if err != nil {
+			return err
+		}
+		c.StatePath = path
 	}
 
-	return nil
+	if err := c.ReadTokenFile(); err != nil {
+		return err
+	}
+
+	return c.Validate()
 }
 
-func signalListener() {
+// signalListener cancel by SIGTERM or SIGINT, and reload config by SIGHUP
+func signalListener(cancel context.CancelFunc, reload func()) {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
-	s := <-sigChan
-	logger.Warnf("Got signal %v", s)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for s := range sigChan {
+		if s == syscall.SIGHUP {
+			logger.Info("Got SIGHUP, reload config")
+			reload()
+			continue
+		}
+		logger.Warnf("Got signal %v", s)
+		cancel()
+		return
+	}
+}
+
+// watchConfig reload config when config file is modified.
+// Modification time is polled by interval until ctx is done.
+func watchConfig(ctx context.Context, path string, interval time.Duration, reload func()) {
+	modTime := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	last := modTime()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if t := modTime(); !t.Equal(last) {
+				last = t
+				logger.Infof("Config file %s is modified, reload config", path)
+				reload()
+			}
+		}
+	}
+}
+
+// reloader return a function which reads config again and applies it to bot.
+// Invalid config is logged and ignored.
+func reloader(bot *haven.RelayBot) func() {
+	return func() {
+		c := &haven.Config{}
+		if err := configure(c); err != nil {
+			logger.Errorf("cant reload config: %v", err)
+			return
+		}
+		bot.Reload(c)
+	}
 }
 
 var showVersion *bool
+var argConfig *string
+var argConfigWatch *time.Duration
 var argToken *string
+var argTokenFile *string
 var argChannels *string
 var argLogLevel *string
+var argMessageLog *string
+var argMessageRetention *time.Duration
+var argOutbox *string
+var argLastSeen *string
+var argReconnectMinWait *time.Duration
+var argReconnectMaxWait *time.Duration
+var argReconnectMaxAttempts *int
+var argShutdownTimeout *time.Duration
+var argControlChannel *string
+var argState *string
+var argAdminUsers *string
+var argWorkspaceAdmins *bool
+var argCommandPrefix *string
+var argCommandMentionOnly *bool
+var argPublicReplies *bool
+var argDeleteOrigin *bool
+var argTransport *string
+var argAppToken *string
+var argSigningSecret *string
+var argEventsAddr *string
+var argAdminAddr *string
+
+// defineFlags define command line options in the flag set
+func defineFlags(fs *flag.FlagSet) {
+	showVersion = fs.Bool("version", false, "Show version and exit")
+	argConfig = fs.String("config", "", "Config file path, json, yaml or toml by extension. SLACK_HAVEN_CONFIG or ~/.slack-haven is read if empty")
+	argConfigWatch = fs.Duration("config-watch", 0, "Interval to check config file modification and reload it, ex. 10s. Disabled if 0")
+	argToken = fs.String("token", "", "Slack token. Prefer token-file or SLACK_HAVEN_TOKEN, command line is visible to other users")
+	argTokenFile = fs.String("token-file", "", "File path to read slack token from, ex. /run/secrets/slack-token")
+	argChannels = fs.String("channel", "", "To relay channels definition, ex. id1,id2 or group1=id1:send-only,id2:receive-only;group2=id3,id4")
+	argLogLevel = fs.String("log", "info", "Logging level. debug|info|warn|error|fatal")
+	argMessageLog = fs.String("message-log", "", "Message log file path. Relayed message ids are kept on memory if empty")
+	argMessageRetention = fs.Duration("message-retention", 0, "Retention window of message log file, ex. 168h")
+	argOutbox = fs.String("outbox", "", "Outbox file path. Undelivered messages are replayed from it after restart. Requires message-log")
+	argLastSeen = fs.String("last-seen", "", "File path to keep last seen message of relay channels. Missed messages are caught up on reconnect")
+	argReconnectMinWait = fs.Duration("reconnect-min-wait", 0, "First wait before retrying connection, ex. 1s")
+	argReconnectMaxWait = fs.Duration("reconnect-max-wait", 0, "Max wait between connection attempts, ex. 5m")
+	argReconnectMaxAttempts = fs.Int("reconnect-max-attempts", 0, "Connection attempts before giving up. 0 is unlimited")
+	argShutdownTimeout = fs.Duration("shutdown-timeout", 0, "How long pending deliveries are waited on shutdown, ex. 30s")
+	argTransport = fs.String("transport", "", "How to receive events. rtm|socket-mode|events-api")
+	argAppToken = fs.String("app-token", "", "Slack app level token for socket mode")
+	argSigningSecret = fs.String("signing-secret", "", "Slack signing secret for events api")
+	argEventsAddr = fs.String("events-addr", "", "Listen address for events api, ex. :3000")
+	argAdminAddr = fs.String("admin-addr", "", "Listen address for admin http server serving /healthz, /readyz and /metrics, ex. :9090")
+	argControlChannel = fs.String("control-channel", "", "Channel id where admin commands managing relay channels are accepted")
+	argState = fs.String("state", "", "File path to keep relay channels and pause changed by admin commands. They take precedence over config also after reload. Default is config file path with .state suffix")
+	argAdminUsers = fs.String("admin-users", "", "Comma separated user ids allowed to run admin commands, ex. U1234,U5678")
+	argWorkspaceAdmins = fs.Bool("workspace-admins", false, "Allow workspace admins and owners to run admin commands")
+	argCommandPrefix = fs.String("command-prefix", "", "First word of bot commands. Default is haven")
+	argCommandMentionOnly = fs.Bool("command-mention-only", false, "Accept only commands mentioning the bot")
+	argPublicReplies = fs.Bool("public-replies", false, "Post command results to the channel instead of only to the sender")
+	argDeleteOrigin = fs.Bool("delete-origin", false, "Delete the origin message when an admin deletes a relayed copy")
+}
 
 func init() {
-	showVersion = flag.Bool("version", false, "Show version and exit")
-	argToken = flag.String("token", "", "Slack token")
-	argChannels = flag.String("channel", "", "To relay channels definition, ex. id1,id2")
-	argLogLevel = flag.String("log", "info", "Logging level. debug|info|warn|error|fatal")
+	defineFlags(flag.CommandLine)
 }
 
 func main() {
@@ -97,7 +334,31 @@ func main() {
 		os.Exit(1)
 	}
 
-	bot := haven.NewRelayBot(c)
-	go bot.Start()
-	signalListener()
+	bot, err := haven.NewRelayBot(c)
+	if err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	reload := reloader(bot)
+	go signalListener(cancel, reload)
+	watch, err := configWatchInterval()
+	if err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if watch > 0 {
+		path := configPath()
+		if path == "" {
+			if path, err = haven.DefaultConfigPath(); err != nil {
+				logger.Errorf("%v", err)
+				os.Exit(1)
+			}
+		}
+		go watchConfig(ctx, path, watch, reload)
+	}
+	if err := bot.Start(ctx); err != nil && err != context.Canceled {
+		logger.Errorf("%v", err)
+		os.Exit(1)
+	}
 }
@@ -1,16 +1,95 @@
 package main
 
 import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/k-saka/slack-haven/haven"
 )
 
 func TestParseChannelsArg(t *testing.T) {
 	input := "1,2"
-	gs := parseChannelsArg(&input)
-	expected := map[string]struct{}{"1": {}, "2": {}}
+	gs, err := parseChannelsArg(&input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]haven.RelayDirection{"default": {"1": haven.Bidirectional, "2": haven.Bidirectional}}
+
+	if !reflect.DeepEqual(gs, expected) {
+		t.Errorf("Group parse failed. input: %s, parsed:%v\n", input, gs)
+	}
+}
+
+func TestParseNamedChannelsArg(t *testing.T) {
+	input := "a=1:send-only,2:receive-only;b=3,4:bidirectional"
+	gs, err := parseChannelsArg(&input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string]haven.RelayDirection{
+		"a": {"1": haven.SendOnly, "2": haven.ReceiveOnly},
+		"b": {"3": haven.Bidirectional, "4": haven.Bidirectional},
+	}
 
 	if !reflect.DeepEqual(gs, expected) {
 		t.Errorf("Group parse failed. input: %s, parsed:%v\n", input, gs)
 	}
+
+	input = "1:sideways,2"
+	if _, err := parseChannelsArg(&input); err == nil {
+		t.Errorf("Expected error for unknown direction. input: %s", input)
+	}
+}
+
+func TestConfigureExplicitFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haven-main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	content := `{"token": "xoxb", "relay-rooms": ["C01", "C02"], "delete-origin": true, "workspace-admins": true, "public-replies": true, "reconnect-max-attempts": 3, "message-log": "log"}`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// environment of the shell doesn't affect the result
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, haven.EnvPrefix) {
+			t.Setenv(kv[:strings.Index(kv, "=")], "")
+		}
+	}
+	// options are parsed by fresh flag set, and discarded after test
+	saved := flag.CommandLine
+	flag.CommandLine = flag.NewFlagSet("slack-haven", flag.ContinueOnError)
+	defineFlags(flag.CommandLine)
+	defer func() {
+		flag.CommandLine = saved
+		defineFlags(flag.NewFlagSet("slack-haven", flag.ContinueOnError))
+	}()
+
+	args := []string{"-config", path, "-delete-origin=false", "-workspace-admins=false", "-reconnect-max-attempts", "0"}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	c := &haven.Config{}
+	if err := configure(c); err != nil {
+		t.Fatal(err)
+	}
+	if c.DeleteOrigin || c.WorkspaceAdmins || c.ReconnectMaxAttempts != 0 {
+		t.Errorf("Expected false and 0 flags overwrite config file. Actual: %+v", c)
+	}
+	// options not given keep config file values
+	if !c.PublicReplies || c.MessageLogPath != "log" {
+		t.Errorf("Expected config file values are kept. Actual: %+v", c)
+	}
+	// admin command changes are kept next to config file by default
+	if c.StatePath != path+".state" {
+		t.Errorf("Expected default state path. Actual: %v", c.StatePath)
+	}
 }